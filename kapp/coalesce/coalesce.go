@@ -0,0 +1,126 @@
+package coalesce
+
+import (
+	"k8s.io/apimachinery/pkg/watch"
+	"sync"
+	"time"
+)
+
+// 合并同一对象在窗口内的多个事件，窗口结束时只输出合并后的事件
+type Coalescer struct {
+	window  time.Duration
+	mutex   sync.Mutex
+	pending map[string]*item
+	// 窗口已经结束、等待输出的事件，按窗口结束的顺序排列
+	ready  []interface{}
+	notify chan struct{}
+	out    chan interface{}
+	stop   chan struct{}
+	once   sync.Once
+}
+
+type item struct {
+	value interface{}
+}
+
+// 合并两个事件，返回新的事件，返回nil时两个事件互相抵消，都不输出
+type MergeFunc func(old, new interface{}) interface{}
+
+func New(window time.Duration) *Coalescer {
+	c := &Coalescer{
+		window:  window,
+		pending: make(map[string]*item),
+		notify:  make(chan struct{}, 1),
+		out:     make(chan interface{}, 100),
+		stop:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// 对象的第一个事件开始计时，窗口内的后续事件通过merge合并到一起
+func (c *Coalescer) Add(key string, value interface{}, merge MergeFunc) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if it, ok := c.pending[key]; ok {
+		if it.value = merge(it.value, value); it.value == nil {
+			delete(c.pending, key)
+		}
+		return
+	}
+	it := &item{value: value}
+	c.pending[key] = it
+	time.AfterFunc(c.window, func() {
+		c.mutex.Lock()
+		// 已经抵消，或者抵消后同一对象又开始了新的窗口
+		if c.pending[key] != it {
+			c.mutex.Unlock()
+			return
+		}
+		delete(c.pending, key)
+		c.ready = append(c.ready, it.value)
+		c.mutex.Unlock()
+		select {
+		case c.notify <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// 由一个协程按顺序输出，out 满时后结束的窗口也不会先输出
+func (c *Coalescer) run() {
+	for {
+		select {
+		case <-c.notify:
+		case <-c.stop:
+			return
+		}
+		for {
+			c.mutex.Lock()
+			if len(c.ready) == 0 {
+				c.mutex.Unlock()
+				break
+			}
+			value := c.ready[0]
+			c.ready = c.ready[1:]
+			c.mutex.Unlock()
+			select {
+			case c.out <- value:
+			case <-c.stop:
+				return
+			}
+		}
+	}
+}
+
+// 窗口结束的事件
+func (c *Coalescer) C() <-chan interface{} {
+	return c.out
+}
+
+// 还在窗口内的对象数
+func (c *Coalescer) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.pending) + len(c.ready) + len(c.out)
+}
+
+// 停止后还在窗口内的事件会被丢弃
+func (c *Coalescer) Stop() {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+}
+
+// 合并后的事件类型：新增后的修改仍然是新增，其他情况取最后的类型
+func MergeType(old, new watch.EventType) watch.EventType {
+	if old == watch.Added && new == watch.Modified {
+		return watch.Added
+	}
+	return new
+}
+
+// 窗口内新增后又删除的对象，接收方不需要知道，两个事件都不输出
+func Cancels(old, new watch.EventType) bool {
+	return old == watch.Added && new == watch.Deleted
+}
@@ -0,0 +1,125 @@
+package coalesce
+
+import (
+	"k8s.io/apimachinery/pkg/watch"
+	"testing"
+	"time"
+)
+
+type change struct {
+	name string
+	typ  watch.EventType
+}
+
+func merge(old, new interface{}) interface{} {
+	o, n := old.(change), new.(change)
+	if Cancels(o.typ, n.typ) {
+		return nil
+	}
+	n.typ = MergeType(o.typ, n.typ)
+	return n
+}
+
+// 读取输出的事件，直到 wait 时间内没有新的事件
+func drain(c *Coalescer, wait time.Duration) []change {
+	var out []change
+	for {
+		select {
+		case v := <-c.C():
+			out = append(out, v.(change))
+		case <-time.After(wait):
+			return out
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	cases := []struct {
+		events []watch.EventType
+		want   []watch.EventType
+	}{
+		{[]watch.EventType{watch.Added}, []watch.EventType{watch.Added}},
+		{[]watch.EventType{watch.Added, watch.Modified}, []watch.EventType{watch.Added}},
+		{[]watch.EventType{watch.Added, watch.Deleted}, nil},
+		{[]watch.EventType{watch.Added, watch.Modified, watch.Deleted}, nil},
+		{[]watch.EventType{watch.Modified, watch.Modified}, []watch.EventType{watch.Modified}},
+		{[]watch.EventType{watch.Modified, watch.Deleted}, []watch.EventType{watch.Deleted}},
+		{[]watch.EventType{watch.Deleted, watch.Added}, []watch.EventType{watch.Added}},
+		// 抵消后再次新增，开始新的窗口
+		{[]watch.EventType{watch.Added, watch.Deleted, watch.Added}, []watch.EventType{watch.Added}},
+	}
+	for _, c := range cases {
+		t.Run(fmtTypes(c.events), func(t *testing.T) {
+			co := New(20 * time.Millisecond)
+			defer co.Stop()
+			for _, typ := range c.events {
+				co.Add("web", change{name: "web", typ: typ}, merge)
+			}
+			got := drain(co, 100*time.Millisecond)
+			if len(got) != len(c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i].typ != c.want[i] {
+					t.Fatalf("got %v, want %v", got, c.want)
+				}
+			}
+			if n := co.Len(); n != 0 {
+				t.Fatalf("%d events left after the window", n)
+			}
+		})
+	}
+}
+
+func fmtTypes(types []watch.EventType) string {
+	s := ""
+	for i, typ := range types {
+		if i > 0 {
+			s += "+"
+		}
+		s += string(typ)
+	}
+	return s
+}
+
+// 按窗口结束的顺序输出，窗口内合并的事件不会提前
+func TestFlushOrder(t *testing.T) {
+	c := New(30 * time.Millisecond)
+	defer c.Stop()
+	c.Add("a", change{name: "a", typ: watch.Modified}, merge)
+	time.Sleep(10 * time.Millisecond)
+	c.Add("b", change{name: "b", typ: watch.Modified}, merge)
+	time.Sleep(10 * time.Millisecond)
+	c.Add("c", change{name: "c", typ: watch.Modified}, merge)
+	c.Add("a", change{name: "a", typ: watch.Deleted}, merge)
+
+	got := drain(c, 100*time.Millisecond)
+	want := []change{{"a", watch.Deleted}, {"b", watch.Modified}, {"c", watch.Modified}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// 抵消的事件原来的定时器不会提前输出之后的新窗口
+func TestCancelKeepsNewWindow(t *testing.T) {
+	c := New(50 * time.Millisecond)
+	defer c.Stop()
+	c.Add("web", change{name: "web", typ: watch.Added}, merge)
+	c.Add("web", change{name: "web", typ: watch.Deleted}, merge)
+	time.Sleep(30 * time.Millisecond)
+	c.Add("web", change{name: "web", typ: watch.Added}, merge)
+
+	select {
+	case v := <-c.C():
+		t.Fatalf("%v was sent before its own window ended", v)
+	case <-time.After(35 * time.Millisecond):
+	}
+	if got := drain(c, 100*time.Millisecond); len(got) != 1 || got[0].typ != watch.Added {
+		t.Fatalf("got %v", got)
+	}
+}
@@ -0,0 +1,119 @@
+package collect
+
+import (
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"kappagent/util/backoff"
+	"net"
+	"time"
+)
+
+// 采集失败的原因
+type Reason string
+
+const (
+	ReasonForbidden    Reason = "Forbidden"
+	ReasonUnauthorized Reason = "Unauthorized"
+	ReasonNotFound     Reason = "NotFound"
+	ReasonTimeout      Reason = "Timeout"
+	ReasonConversion   Reason = "Conversion"
+	ReasonUnavailable  Reason = "Unavailable"
+	ReasonUnknown      Reason = "Unknown"
+)
+
+// 采集数据失败
+type Error struct {
+	Reason    Reason
+	Resource  string
+	Namespace string
+	Err       error
+}
+
+func (e *Error) Error() string {
+	if e.Namespace != "" {
+		return fmt.Sprintf("获取 %s(namespace: %s) 失败[%s]: %s", e.Resource, e.Namespace, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("获取 %s 失败[%s]: %s", e.Resource, e.Reason, e.Err)
+}
+
+// 权限不足或资源不存在时重试没有意义
+func (e *Error) Permanent() bool {
+	return e.Reason == ReasonForbidden || e.Reason == ReasonUnauthorized || e.Reason == ReasonNotFound
+}
+
+func (e *Error) Failure() Failure {
+	return Failure{
+		Resource:  e.Resource,
+		Namespace: e.Namespace,
+		Reason:    e.Reason,
+		Message:   e.Err.Error(),
+	}
+}
+
+// 根据k8s接口返回的错误生成采集错误
+func NewError(resource, namespace string, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{
+		Reason:    reasonOf(err),
+		Resource:  resource,
+		Namespace: namespace,
+		Err:       err,
+	}
+}
+
+// watch 返回的对象类型不符合预期
+func NewConversionError(resource, namespace string, obj runtime.Object) *Error {
+	return &Error{
+		Reason:    ReasonConversion,
+		Resource:  resource,
+		Namespace: namespace,
+		Err:       fmt.Errorf("无法转换对象类型: %T", obj),
+	}
+}
+
+func reasonOf(err error) Reason {
+	switch {
+	case apierrors.IsForbidden(err):
+		return ReasonForbidden
+	case apierrors.IsUnauthorized(err):
+		return ReasonUnauthorized
+	case apierrors.IsNotFound(err):
+		return ReasonNotFound
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return ReasonTimeout
+	case apierrors.IsServiceUnavailable(err), apierrors.IsTooManyRequests(err), apierrors.IsInternalError(err):
+		return ReasonUnavailable
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ReasonTimeout
+	}
+	return ReasonUnknown
+}
+
+// 上报数据中记录的采集失败信息
+type Failure struct {
+	Resource  string `json:"resource"`
+	Namespace string `json:"namespace,omitempty"`
+	Reason    Reason `json:"reason"`
+	Message   string `json:"message"`
+}
+
+// 重试调用k8s接口，权限不足和资源不存在不重试
+func Retry(attempts int, resource, namespace string, f func() error) *Error {
+	b := backoff.NewBackoff(500*time.Millisecond, 5*time.Second)
+	var cerr *Error
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		cerr = NewError(resource, namespace, err)
+		if cerr.Permanent() || attempt >= attempts {
+			return cerr
+		}
+		time.Sleep(b.Duration(attempt))
+	}
+}
@@ -0,0 +1,209 @@
+package diff
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"k8s.io/apimachinery/pkg/watch"
+	"kappagent/kapp/event"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 发送数据的模式
+const (
+	// 每次都发送完整对象
+	ModeFull = "full"
+	// 发送相对上次版本的JSON Patch，定期发送完整对象作为基准
+	ModeDiff = "diff"
+)
+
+// JSON Patch(RFC 6902) 中的一个操作
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// remove 以外的操作即使值为null也要带上value
+func (o Operation) MarshalJSON() ([]byte, error) {
+	if o.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{o.Op, o.Path})
+	}
+	return json.Marshal(struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value"`
+	}{o.Op, o.Path, o.Value})
+}
+
+// 相对上次发送版本的差异数据
+type Patch struct {
+	// 精简数据结构时为 schema.Version，完整k8s对象时为空
+	SchemaVersion string          `json:"schemaVersion,omitempty"`
+	ClusterName   string          `json:"clusterName"`
+	Timestamp     int64           `json:"timestamp"`
+	ResourceType  string          `json:"resourceType"`
+	Type          watch.EventType `json:"type"`
+	Namespace     string          `json:"namespace,omitempty"`
+	Name          string          `json:"name"`
+	// 应用patch前对象的hash，接收方据此判断是否有对应的基准版本
+	BaseHash string `json:"baseHash"`
+	// 应用patch后对象的hash
+	Hash  string      `json:"hash"`
+	Patch []Operation `json:"patch"`
+	event.Meta
+}
+
+// 一次计算的结果，发送成功后需要Commit
+type Change struct {
+	key string
+	doc interface{}
+	// 需要发送完整对象
+	Full     bool
+	BaseHash string
+	Hash     string
+	Patch    []Operation
+}
+
+type entry struct {
+	doc  interface{}
+	hash string
+	base time.Time
+}
+
+// 记录每个对象上次发送成功的版本
+type Tracker struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	objects  map[string]*entry
+}
+
+// interval 为发送完整对象的最长间隔，0表示只在第一次发送完整对象
+func NewTracker(interval time.Duration) *Tracker {
+	return &Tracker{
+		interval: interval,
+		objects:  make(map[string]*entry),
+	}
+}
+
+func Key(resource, namespace, name string) string {
+	return resource + "/" + namespace + "/" + name
+}
+
+// 计算对象相对上次发送版本的差异
+func (t *Tracker) Compute(key string, obj interface{}) (*Change, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	change := &Change{key: key, doc: doc, Hash: hex.EncodeToString(sum[:])}
+
+	t.mutex.Lock()
+	last := t.objects[key]
+	t.mutex.Unlock()
+
+	if last == nil || t.interval > 0 && time.Since(last.base) >= t.interval {
+		change.Full = true
+		return change, nil
+	}
+
+	change.BaseHash = last.hash
+	change.Patch = compare(nil, last.doc, doc, nil)
+	// patch 比完整对象还大时直接发送完整对象
+	if patch, err := json.Marshal(change.Patch); err != nil || len(patch) >= len(data) {
+		change.Full = true
+		change.Patch = nil
+	}
+	return change, nil
+}
+
+// 发送成功后记录为新的版本
+func (t *Tracker) Commit(c *Change) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	e := &entry{doc: c.doc, hash: c.Hash, base: time.Now()}
+	if last := t.objects[c.key]; last != nil && !c.Full {
+		e.base = last.base
+	}
+	t.objects[c.key] = e
+}
+
+// 对象被删除或者发送了不完整的数据，下次发送完整对象
+func (t *Tracker) Forget(key string) {
+	t.mutex.Lock()
+	delete(t.objects, key)
+	t.mutex.Unlock()
+}
+
+// 比较两个json文档，生成把 a 变成 b 的操作
+func compare(ops []Operation, a, b interface{}, path []string) []Operation {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		// 按key排序，相同的变化生成相同的patch
+		for _, k := range sortedKeys(av) {
+			if nv, ok := bv[k]; ok {
+				ops = compare(ops, av[k], nv, append(path, k))
+			} else {
+				ops = append(ops, Operation{Op: "remove", Path: pointer(append(path, k))})
+			}
+		}
+		for _, k := range sortedKeys(bv) {
+			if _, ok := av[k]; !ok {
+				ops = append(ops, Operation{Op: "add", Path: pointer(append(path, k)), Value: bv[k]})
+			}
+		}
+		return ops
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			break
+		}
+		for i := range av {
+			ops = compare(ops, av[i], bv[i], append(path, strconv.Itoa(i)))
+		}
+		return ops
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		ops = append(ops, Operation{Op: "replace", Path: pointer(path), Value: b})
+	}
+	return ops
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// 生成 JSON Pointer(RFC 6901)
+func pointer(path []string) string {
+	var b strings.Builder
+	for _, p := range path {
+		b.WriteString("/")
+		b.WriteString(pointerEscaper.Replace(p))
+	}
+	return b.String()
+}
@@ -0,0 +1,223 @@
+package diff
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 按接收方的方式应用patch，只支持 compare 生成的操作
+func apply(t *testing.T, doc interface{}, ops []Operation) interface{} {
+	// 先经过json序列化，和接收方收到的数据一致
+	data, err := json.Marshal(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	doc = clone(t, doc)
+	for _, op := range decoded {
+		path := op["path"].(string)
+		if path == "" {
+			doc = op["value"]
+			continue
+		}
+		tokens := strings.Split(path[1:], "/")
+		for i := range tokens {
+			tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(tokens[i])
+		}
+		parent := doc
+		for _, tok := range tokens[:len(tokens)-1] {
+			parent = child(t, parent, tok)
+		}
+		last := tokens[len(tokens)-1]
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if op["op"] == "remove" {
+				delete(p, last)
+			} else {
+				p[last] = op["value"]
+			}
+		case []interface{}:
+			if op["op"] != "replace" {
+				t.Fatalf("unexpected %s on array element %s", op["op"], path)
+			}
+			i, err := strconv.Atoi(last)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p[i] = op["value"]
+		default:
+			t.Fatalf("path %s does not exist", path)
+		}
+	}
+	return doc
+}
+
+func child(t *testing.T, doc interface{}, tok string) interface{} {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		return d[tok]
+	case []interface{}:
+		i, err := strconv.Atoi(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d[i]
+	}
+	t.Fatalf("cannot descend into %v", doc)
+	return nil
+}
+
+func clone(t *testing.T, doc interface{}) interface{} {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func parse(t *testing.T, s string) interface{} {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(s), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestCompareRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b string
+	}{
+		{"unchanged", `{"a":1,"b":{"c":[1,2]}}`, `{"a":1,"b":{"c":[1,2]}}`},
+		{"replace scalar", `{"a":1,"b":"x"}`, `{"a":2,"b":"y"}`},
+		{"add and remove keys", `{"a":1,"b":2}`, `{"b":2,"c":{"d":true}}`},
+		{"nested", `{"spec":{"replicas":1,"template":{"labels":{"app":"x"}}}}`, `{"spec":{"replicas":3,"template":{"labels":{"app":"x","v":"2"}}}}`},
+		{"array element", `{"containers":[{"image":"a:1"},{"image":"b:1"}]}`, `{"containers":[{"image":"a:1"},{"image":"b:2"}]}`},
+		{"array length", `{"ports":[80]}`, `{"ports":[80,443]}`},
+		{"type change", `{"a":{"b":1}}`, `{"a":[1]}`},
+		{"null value", `{"a":1}`, `{"a":null}`},
+		{"escaped keys", `{"a/b":1,"c~d":{"e":1}}`, `{"a/b":2,"c~d":{"e":2}}`},
+		{"root", `[1]`, `{"a":1}`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := parse(t, c.a), parse(t, c.b)
+			ops := compare(nil, a, b, nil)
+			if c.a == c.b && len(ops) != 0 {
+				t.Fatalf("unchanged document produced %v", ops)
+			}
+			if got := apply(t, a, ops); !reflect.DeepEqual(got, b) {
+				t.Fatalf("applying %v to %s gave %v, want %s", ops, c.a, got, c.b)
+			}
+		})
+	}
+}
+
+func TestComparePointer(t *testing.T) {
+	ops := compare(nil, parse(t, `{"a/b":{"c~d":1}}`), parse(t, `{"a/b":{"c~d":2}}`), nil)
+	if len(ops) != 1 || ops[0].Path != "/a~1b/c~0d" || ops[0].Op != "replace" {
+		t.Fatalf("unexpected ops %v", ops)
+	}
+	// 相同的变化生成相同的patch
+	a := parse(t, `{"x":1,"y":1,"z":1}`)
+	b := parse(t, `{"x":2,"y":2,"w":1}`)
+	first, _ := json.Marshal(compare(nil, a, b, nil))
+	for i := 0; i < 10; i++ {
+		again, _ := json.Marshal(compare(nil, a, b, nil))
+		if string(again) != string(first) {
+			t.Fatalf("patch is not stable: %s vs %s", first, again)
+		}
+	}
+}
+
+type object struct {
+	Name     string            `json:"name"`
+	Replicas int               `json:"replicas"`
+	Labels   map[string]string `json:"labels"`
+	Images   []string          `json:"images"`
+}
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker(0)
+	key := Key("Deployment", "default", "web")
+	v1 := object{Name: "web", Replicas: 1, Labels: map[string]string{"app": "web", "team": "a"}, Images: []string{"web:1", "sidecar:1"}}
+
+	first, err := tracker.Compute(key, v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Full || first.Hash == "" {
+		t.Fatalf("first change should be full: %+v", first)
+	}
+	// 没有Commit时仍然发送完整对象
+	if again, _ := tracker.Compute(key, v1); !again.Full {
+		t.Fatal("uncommitted change should not become the base")
+	}
+	tracker.Commit(first)
+
+	v2 := v1
+	v2.Replicas = 2
+	second, err := tracker.Compute(key, v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Full || second.BaseHash != first.Hash || second.Hash == first.Hash {
+		t.Fatalf("second change should be a patch on the first: %+v", second)
+	}
+	if got := apply(t, first.doc, second.Patch); !reflect.DeepEqual(got, clone(t, v2)) {
+		t.Fatalf("patch does not produce the new version: %v", got)
+	}
+	tracker.Commit(second)
+
+	tracker.Forget(key)
+	if third, _ := tracker.Compute(key, v2); !third.Full {
+		t.Fatal("forgotten object should be sent in full")
+	}
+}
+
+func TestTrackerFullWhenPatchIsLarger(t *testing.T) {
+	tracker := NewTracker(0)
+	key := Key("Node", "", "n1")
+	first, _ := tracker.Compute(key, map[string]string{"a": "1"})
+	tracker.Commit(first)
+	change, err := tracker.Compute(key, map[string]string{"b": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !change.Full || change.Patch != nil {
+		t.Fatalf("patch larger than the object should fall back to full: %+v", change)
+	}
+}
+
+func TestTrackerInterval(t *testing.T) {
+	tracker := NewTracker(20 * time.Millisecond)
+	key := Key("Deployment", "default", "web")
+	v1 := object{Name: "web", Replicas: 1, Labels: map[string]string{"app": "web"}, Images: []string{"web:1"}}
+	first, _ := tracker.Compute(key, v1)
+	tracker.Commit(first)
+
+	v1.Replicas = 2
+	patch, _ := tracker.Compute(key, v1)
+	if patch.Full {
+		t.Fatal("change within the interval should be a patch")
+	}
+	tracker.Commit(patch)
+
+	time.Sleep(30 * time.Millisecond)
+	v1.Replicas = 3
+	if full, _ := tracker.Compute(key, v1); !full.Full {
+		t.Fatal("change after the interval should be full")
+	}
+}
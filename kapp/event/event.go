@@ -0,0 +1,67 @@
+package event
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"sync/atomic"
+	"time"
+)
+
+// 每条数据都带有的元信息，接收方用来发现丢失、乱序和重复的数据
+type Meta struct {
+	// agent 每次启动生成新的stream，同一个stream内sequence从1开始连续递增。
+	// 有多个发送协程时每个协程一个stream
+	Stream   string `json:"stream"`
+	Sequence uint64 `json:"sequence"`
+	// 对象的uid和resourceVersion，全量数据没有
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	// 相同的数据重复发送时相同
+	IdempotencyKey string `json:"idempotencyKey"`
+}
+
+func (m *Meta) SetMeta(meta Meta) {
+	*m = meta
+}
+
+// 按集群生成递增的序号
+type Sequencer struct {
+	cluster string
+	stream  string
+	last    uint64
+}
+
+func NewSequencer(cluster string) *Sequencer {
+	return &Sequencer{cluster: cluster, stream: newStream()}
+}
+
+// watch事件的元信息
+func (s *Sequencer) Event(resource string, eventType watch.EventType, obj metav1.Object) Meta {
+	return Meta{
+		Stream:          s.stream,
+		Sequence:        atomic.AddUint64(&s.last, 1),
+		UID:             string(obj.GetUID()),
+		ResourceVersion: obj.GetResourceVersion(),
+		IdempotencyKey:  fmt.Sprintf("%s/%s/%s/%s/%s", s.cluster, resource, obj.GetUID(), obj.GetResourceVersion(), eventType),
+	}
+}
+
+// 注册和全量同步数据的元信息，kind 为 register 或 resync
+func (s *Sequencer) Project(kind, hash string) Meta {
+	return Meta{
+		Stream:         s.stream,
+		Sequence:       atomic.AddUint64(&s.last, 1),
+		IdempotencyKey: fmt.Sprintf("%s/%s/%s", s.cluster, kind, hash),
+	}
+}
+
+func newStream() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,248 @@
+package kapp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
+	"kappagent/util/backoff"
+	"kappagent/util/k8s"
+	"kappagent/util/sink"
+	"kappagent/util/tool"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"sync"
+	"time"
+)
+
+var errAgentExited = errors.New("采集意外退出")
+
+// 多集群配置中的一个集群
+// 设置了Server时使用token访问，否则使用kubeconfig中的context
+type ClusterConfig struct {
+	Name       string `json:"name"`
+	Cloud      string `json:"cloud"`
+	KubeConfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+	Server     string `json:"server,omitempty"`
+	TokenFile  string `json:"tokenFile,omitempty"`
+	CAFile     string `json:"caFile,omitempty"`
+}
+
+type clustersFile struct {
+	Clusters []ClusterConfig `json:"clusters"`
+}
+
+// 读取多集群配置文件(yaml或json)，没有填写cloud的集群使用defaultCloud
+func LoadClusters(path, defaultCloud string) ([]ClusterConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f clustersFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("解析集群配置失败: %v", err)
+	}
+	if len(f.Clusters) == 0 {
+		return nil, fmt.Errorf("集群配置 %s 中没有集群", path)
+	}
+
+	names := make(map[string]bool, len(f.Clusters))
+	for i := range f.Clusters {
+		c := &f.Clusters[i]
+		if c.Name == "" {
+			return nil, fmt.Errorf("第%d个集群没有填写name", i+1)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("集群名称重复: %s", c.Name)
+		}
+		names[c.Name] = true
+		if c.Cloud == "" {
+			c.Cloud = defaultCloud
+		}
+	}
+	return f.Clusters, nil
+}
+
+func (c ClusterConfig) client() (*kubernetes.Clientset, error) {
+	if c.Server != "" {
+		return k8s.NewClientFromToken(c.Server, c.TokenFile, c.CAFile)
+	}
+	return k8s.NewClientFromContext(c.KubeConfig, c.Context)
+}
+
+// 在一个进程里采集多个集群，每个集群独立运行，共用同一个sink
+// 单个集群出错或panic时只重启这个集群
+type Group struct {
+	clusters []ClusterConfig
+	sink     sink.Sink
+	regExp   *regexp.Regexp
+	mutex    sync.RWMutex
+	members  map[string]*member
+	closed   bool
+	stop     chan struct{}
+	closer   sync.WaitGroup
+}
+
+type member struct {
+	kapp      KappService
+	lastError string
+	restarts  int
+}
+
+// 单个集群的健康状态
+type memberStatus struct {
+	OK        bool        `json:"ok"`
+	LastError string      `json:"lastError,omitempty"`
+	Restarts  int         `json:"restarts"`
+	Status    interface{} `json:"status,omitempty"`
+}
+
+func NewGroup(clusters []ClusterConfig, s sink.Sink, regExp *regexp.Regexp) KappService {
+	members := make(map[string]*member, len(clusters))
+	for _, c := range clusters {
+		members[c.Name] = &member{}
+	}
+	return &Group{
+		clusters: clusters,
+		sink:     s,
+		regExp:   regExp,
+		members:  members,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (g *Group) Run() error {
+	for _, c := range g.clusters {
+		g.closer.Add(1)
+		go g.runCluster(c)
+	}
+	g.closer.Wait()
+	return nil
+}
+
+func (g *Group) Close() {
+	g.mutex.Lock()
+	if g.closed {
+		g.mutex.Unlock()
+		return
+	}
+	g.closed = true
+	close(g.stop)
+	var running []KappService
+	for _, m := range g.members {
+		if m.kapp != nil {
+			running = append(running, m.kapp)
+		}
+	}
+	g.mutex.Unlock()
+
+	for _, k := range running {
+		k.Close()
+	}
+}
+
+// 就绪检查：所有集群都就绪
+func (g *Group) Ready() (bool, interface{}) {
+	return g.check(func(k KappService) (bool, interface{}) {
+		return k.Ready()
+	}, true)
+}
+
+// 存活检查：只有所有集群都没有进展时才失败，重启进程解决不了单个集群的问题
+func (g *Group) Live() (bool, interface{}) {
+	return g.check(func(k KappService) (bool, interface{}) {
+		return k.Live()
+	}, false)
+}
+
+// all为true时要求所有集群通过，否则只要有一个集群通过
+func (g *Group) check(f func(k KappService) (bool, interface{}), all bool) (bool, interface{}) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	result := make(map[string]memberStatus, len(g.members))
+	passed := 0
+	for name, m := range g.members {
+		s := memberStatus{LastError: m.lastError, Restarts: m.restarts}
+		if m.kapp != nil {
+			s.OK, s.Status = f(m.kapp)
+		}
+		if s.OK {
+			passed++
+		}
+		result[name] = s
+	}
+
+	if all {
+		return passed == len(g.members), result
+	}
+	return passed > 0, result
+}
+
+// 运行单个集群，出错后退避重启，直到关闭
+func (g *Group) runCluster(c ClusterConfig) {
+	defer g.closer.Done()
+	log := tool.Log.WithField(tool.FieldCluster, c.Name)
+	b := backoff.NewBackoff(5*time.Second, 5*time.Minute)
+
+	for attempt := 1; ; attempt++ {
+		err := g.runOnce(c)
+		if g.isClosed() {
+			return
+		}
+		if err == nil {
+			err = errAgentExited
+		}
+
+		wait := b.Duration(attempt)
+		log.WithError(err).WithField("wait", wait.String()).Error("集群采集出错，稍后重启")
+		g.mutex.Lock()
+		m := g.members[c.Name]
+		prev := m.kapp
+		m.kapp = nil
+		m.lastError = err.Error()
+		m.restarts++
+		g.mutex.Unlock()
+		// 重启前关闭上一次的采集，避免遗留watch和发送协程
+		if prev != nil {
+			prev.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+func (g *Group) runOnce(c ClusterConfig) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	clientSet, err := c.client()
+	if err != nil {
+		return fmt.Errorf("初始化client失败: %v", err)
+	}
+	k := NewKapp(clientSet, c.Name, c.Cloud, g.sink, g.regExp)
+
+	g.mutex.Lock()
+	if g.closed {
+		g.mutex.Unlock()
+		return nil
+	}
+	g.members[c.Name].kapp = k
+	g.mutex.Unlock()
+
+	return k.Run()
+}
+
+func (g *Group) isClosed() bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.closed
+}
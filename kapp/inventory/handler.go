@@ -0,0 +1,120 @@
+package inventory
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"kappagent/kapp/schema"
+	"kappagent/util/tool"
+	"net/http"
+	"strings"
+)
+
+const envInventoryToken = "INVENTORY_API_TOKEN"
+
+// 查询接口的返回数据
+type List struct {
+	SchemaVersion string `json:"schemaVersion"`
+	ClusterName   string `json:"clusterName"`
+	// 数据最后更新的时间
+	Timestamp int64       `json:"timestamp"`
+	Items     interface{} `json:"items"`
+}
+
+type errorBody struct {
+	Error    string   `json:"error"`
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+// 只读查询接口，注册在 /v1/ 下，路径见README。
+// 多集群时通过 cluster 参数选择集群。设置了 INVENTORY_API_TOKEN 时需要 Authorization: Bearer <token>
+func Handler() http.Handler {
+	token := tool.EnvString(envInventoryToken, "")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, errorBody{Error: "unauthorized"})
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+			return
+		}
+
+		s, status, body := selectStore(r.URL.Query().Get("cluster"))
+		if s == nil {
+			writeJSON(w, status, body)
+			return
+		}
+		synced, updated := s.status()
+		if !synced {
+			writeJSON(w, http.StatusServiceUnavailable, errorBody{Error: "cluster not synced yet"})
+			return
+		}
+
+		items, ok := route(s, r)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, errorBody{Error: "not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, List{
+			SchemaVersion: schema.Version,
+			ClusterName:   s.cluster,
+			Timestamp:     updated.Unix(),
+			Items:         items,
+		})
+	})
+}
+
+func authorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// 只有一个集群时可以不指定cluster
+func selectStore(cluster string) (*Store, int, errorBody) {
+	if cluster != "" {
+		if s := lookup(cluster); s != nil {
+			return s, 0, errorBody{}
+		}
+		return nil, http.StatusNotFound, errorBody{Error: "unknown cluster", Clusters: clusters()}
+	}
+	names := clusters()
+	switch len(names) {
+	case 0:
+		return nil, http.StatusServiceUnavailable, errorBody{Error: "cluster not synced yet"}
+	case 1:
+		return lookup(names[0]), 0, errorBody{}
+	}
+	return nil, http.StatusBadRequest, errorBody{Error: "cluster parameter is required", Clusters: names}
+}
+
+func route(s *Store, r *http.Request) (interface{}, bool) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "namespaces":
+		return s.Namespaces(), true
+	case len(parts) == 1 && parts[0] == "nodes":
+		return s.Nodes(), true
+	case len(parts) == 1 && parts[0] == "workloads":
+		q := r.URL.Query()
+		return s.Workloads(q.Get("namespace"), q.Get("kind")), true
+	case len(parts) == 5 && parts[0] == "workloads" && parts[4] == "pods":
+		w, ok := s.Workload(parts[2], parts[1], parts[3])
+		if !ok {
+			return nil, false
+		}
+		return w.Pods, true
+	}
+	return nil, false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		tool.Log.Error(err)
+	}
+}
@@ -0,0 +1,231 @@
+package inventory
+
+import (
+	"kappagent/kapp/schema"
+	"kappagent/util/tool"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const envInventoryAPI = "INVENTORY_API"
+
+var (
+	mutex  sync.RWMutex
+	stores = make(map[string]*Store)
+)
+
+// 是否开启查询接口，没有开启时agent不维护内存中的数据
+func Enabled() bool {
+	return tool.EnvBool(envInventoryAPI, false)
+}
+
+// 创建集群的数据，集群重启后替换掉旧的。没有开启查询接口时返回nil
+func Register(cluster string) *Store {
+	if !Enabled() {
+		return nil
+	}
+	s := &Store{
+		cluster:    cluster,
+		namespaces: make(map[string]bool),
+		workloads:  make(map[string]schema.Workload),
+		nodes:      make(map[string]schema.Node),
+	}
+	mutex.Lock()
+	stores[cluster] = s
+	mutex.Unlock()
+	return s
+}
+
+func lookup(cluster string) *Store {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return stores[cluster]
+}
+
+func clusters() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	names := make([]string, 0, len(stores))
+	for name := range stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 集群当前的资源，由注册、全量同步和watch事件更新，使用精简数据结构
+type Store struct {
+	mutex      sync.RWMutex
+	cluster    string
+	synced     bool
+	updated    time.Time
+	namespaces map[string]bool
+	workloads  map[string]schema.Workload
+	nodes      map[string]schema.Node
+}
+
+func workloadKey(kind, namespace, name string) string {
+	return strings.ToLower(kind) + "/" + namespace + "/" + name
+}
+
+// 用全量数据替换
+func (s *Store) Replace(p *schema.Project) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.namespaces = make(map[string]bool, len(p.Namespaces))
+	s.workloads = make(map[string]schema.Workload)
+	s.nodes = make(map[string]schema.Node, len(p.Nodes))
+	for _, ns := range p.Namespaces {
+		s.namespaces[ns.Name] = true
+		for _, w := range ns.Deployments {
+			s.workloads[workloadKey(w.Kind, w.Namespace, w.Name)] = w
+		}
+		for _, w := range ns.StatefulSets {
+			s.workloads[workloadKey(w.Kind, w.Namespace, w.Name)] = w
+		}
+	}
+	for _, n := range p.Nodes {
+		s.nodes[n.Name] = n
+	}
+	s.synced = true
+	s.updated = time.Now()
+}
+
+// complete 为false(pod获取失败)时保留之前的pod
+func (s *Store) UpsertWorkload(w schema.Workload, complete bool) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := workloadKey(w.Kind, w.Namespace, w.Name)
+	if old, ok := s.workloads[key]; ok && !complete {
+		w.Pods = old.Pods
+	}
+	s.workloads[key] = w
+	s.namespaces[w.Namespace] = true
+	s.updated = time.Now()
+}
+
+func (s *Store) DeleteWorkload(kind, namespace, name string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.workloads, workloadKey(kind, namespace, name))
+	s.updated = time.Now()
+}
+
+func (s *Store) UpsertNode(n schema.Node) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nodes[n.Name] = n
+	s.updated = time.Now()
+}
+
+func (s *Store) DeleteNode(name string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.nodes, name)
+	s.updated = time.Now()
+}
+
+// namespace 及其中的资源数
+type NamespaceInfo struct {
+	Name         string `json:"name"`
+	Deployments  int    `json:"deployments"`
+	StatefulSets int    `json:"statefulsets"`
+}
+
+func (s *Store) Namespaces() []NamespaceInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	infos := make(map[string]*NamespaceInfo, len(s.namespaces))
+	for name := range s.namespaces {
+		infos[name] = &NamespaceInfo{Name: name}
+	}
+	for _, w := range s.workloads {
+		info := infos[w.Namespace]
+		if info == nil {
+			continue
+		}
+		if w.Kind == "Deployment" {
+			info.Deployments++
+		} else {
+			info.StatefulSets++
+		}
+	}
+	list := make([]NamespaceInfo, 0, len(infos))
+	for _, info := range infos {
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// namespace、kind 为空时不过滤，kind 不区分大小写
+func (s *Store) Workloads(namespace, kind string) []schema.Workload {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	list := make([]schema.Workload, 0)
+	for _, w := range s.workloads {
+		if namespace != "" && w.Namespace != namespace {
+			continue
+		}
+		if kind != "" && !strings.EqualFold(w.Kind, kind) {
+			continue
+		}
+		list = append(list, w)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Namespace != list[j].Namespace {
+			return list[i].Namespace < list[j].Namespace
+		}
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (s *Store) Workload(kind, namespace, name string) (schema.Workload, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	w, ok := s.workloads[workloadKey(kind, namespace, name)]
+	return w, ok
+}
+
+func (s *Store) Nodes() []schema.Node {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	list := make([]schema.Node, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// 是否已经有全量数据，以及最后更新的时间
+func (s *Store) status() (bool, time.Time) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.synced, s.updated
+}
@@ -1,68 +1,197 @@
 package kapp
 
 import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/kubernetes"
+	"kappagent/kapp/diff"
+	"kappagent/kapp/inventory"
+	"kappagent/kapp/option"
+	"kappagent/kapp/rbac"
 	"kappagent/kapp/v1"
 	"kappagent/kapp/v2"
-	"kappagent/util/k8s"
+	"kappagent/util/health"
+	"kappagent/util/sink"
 	"kappagent/util/tool"
-	"os"
 	"regexp"
+	"sync"
 )
 
 type Kapp struct {
 	clientSet *kubernetes.Clientset
 	v1Agent   v1.Service
 	v2Agent   v2.Service
+	regPolicy RegPolicy
+	regState  regState
+	stop      chan struct{}
+	stopOnce  sync.Once
+	mutex     sync.RWMutex
+	current   agent
+	// 注册完成或放弃注册，开始watch
+	running bool
+	log     *logrus.Entry
 }
 
 type KappService interface {
-	Run()
+	// 运行到关闭为止，无法继续采集时返回错误
+	Run() error
 	Close()
+	Ready() (bool, interface{})
+	Live() (bool, interface{})
 }
 
-func NewKapp(clusterName, cloud, siteUrl string, regExp *regexp.Regexp) KappService {
-	clientSet := k8s.InitClient()
+// v1、v2 agent 的公共方法
+type agent interface {
+	StartRegCluster(ctx context.Context) bool
+	Snapshot() (interface{}, error)
+	Run() error
+	Close()
+	Health() *health.Tracker
+}
+
+func NewKapp(clientSet *kubernetes.Clientset, clusterName, cloud string, s sink.Sink, regExp *regexp.Regexp) KappService {
+	return newKapp(clientSet, clusterName, cloud, s, regExp)
+}
+
+func newKapp(clientSet *kubernetes.Clientset, clusterName, cloud string, s sink.Sink, regExp *regexp.Regexp) *Kapp {
+	opt := option.NewOptionsFromEnv()
+	opt.Inventory = inventory.Register(clusterName)
+	// diff模式需要知道上一个版本已经送达，否则之后的patch引用的基准接收方可能没有
+	if opt.PayloadMode == diff.ModeDiff && s != nil && sink.Deferred(s) {
+		tool.Log.WithField(tool.FieldCluster, clusterName).Warn("批量发送或发送队列时事件在送达前返回，不使用diff模式，发送完整数据")
+		opt.PayloadMode = diff.ModeFull
+	}
 	return &Kapp{
 		clientSet: clientSet,
-		v1Agent:   v1.NewV1Agent(clientSet, clusterName, cloud, siteUrl, regExp),
-		v2Agent:   v2.NewV2Agent(clientSet, clusterName, cloud, siteUrl, regExp),
+		v1Agent:   v1.NewV1Agent(clientSet, clusterName, cloud, s, regExp, opt),
+		v2Agent:   v2.NewV2Agent(clientSet, clusterName, cloud, s, regExp, opt),
+		regPolicy: NewRegPolicyFromEnv(),
+		stop:      make(chan struct{}),
+		log:       tool.Log.WithField(tool.FieldCluster, clusterName),
 	}
 }
 
-func (k *Kapp) Run() {
-	tool.Log.Infof("集群版本: %s", k.getVersion())
-	if k.isOldCluster() {
-		for {
-			if success := k.v1Agent.StartRegCluster(); success {
-				break
-			}
-		}
-		k.v1Agent.Run()
-	} else {
-		for {
-			if success := k.v2Agent.StartRegCluster(); success {
-				break
-			}
+func (k *Kapp) Run() error {
+	a, err := k.detect()
+	if err != nil {
+		return err
+	}
+	if err := k.register(a); err != nil {
+		if err == errStopped {
+			return nil
 		}
-		k.v2Agent.Run()
+		return err
+	}
+	select {
+	case <-k.stop:
+		return nil
+	default:
 	}
+	k.mutex.Lock()
+	k.running = true
+	k.mutex.Unlock()
+	return a.Run()
 }
 
 func (k *Kapp) Close() {
-	if k.isOldCluster() {
-		k.v1Agent.Close()
-	} else {
-		k.v2Agent.Close()
+	k.stopOnce.Do(func() {
+		close(k.stop)
+		if a := k.agent(); a != nil {
+			a.Close()
+		}
+	})
+}
+
+func (k *Kapp) RegStatus() RegStatus {
+	return k.regState.get()
+}
+
+// 就绪检查：集群注册成功(或按策略放弃注册后继续运行)并且所有watch都已建立
+func (k *Kapp) Ready() (bool, interface{}) {
+	reg := k.RegStatus()
+	a := k.agent()
+	if a == nil {
+		return false, health.Status{NotReady: []string{"agent"}, Registration: reg}
+	}
+	status := a.Health().Status()
+	status.Registration = reg
+	if !reg.Registered && !(reg.Exhausted && k.regPolicy.GiveUp == GiveUpContinue) {
+		status.NotReady = append(status.NotReady, "registration")
+	}
+	return len(status.NotReady) == 0, status
+}
+
+// 存活检查：watch和发送协程在阈值时间内有进展。
+// 开始watch之前(识别集群版本、注册重试中)总是存活，注册失败由注册策略处理
+func (k *Kapp) Live() (bool, interface{}) {
+	a := k.agent()
+	if a == nil || !k.isRunning() {
+		return true, health.Status{Registration: k.RegStatus()}
+	}
+	status := a.Health().Status()
+	status.Registration = k.RegStatus()
+	return len(status.NotLive) == 0, status
+}
+
+// 生成与注册时相同的全量数据，不发送，用于调试
+func Snapshot(clientSet *kubernetes.Clientset, clusterName, cloud string, regExp *regexp.Regexp) (interface{}, error) {
+	k := newKapp(clientSet, clusterName, cloud, nil, regExp)
+	a, err := k.detect()
+	if err != nil {
+		return nil, err
+	}
+	return a.Snapshot()
+}
+
+// agent 所需的最小权限 ClusterRole，同时包含新老集群需要的资源
+func ClusterRoleYAML(name string) (string, error) {
+	rules := append([]rbac.Rule{}, v1.Rules...)
+	rules = append(rules, v2.Rules...)
+	return rbac.ClusterRoleYAML(name, rules)
+}
+
+// 根据集群版本选择agent
+func (k *Kapp) detect() (agent, error) {
+	version, err := k.getVersion()
+	if err != nil {
+		return nil, err
 	}
+	k.log.WithField("version", version).Info("集群版本")
+
+	old, err := k.isOldCluster()
+	if err != nil {
+		return nil, err
+	}
+	var a agent = k.v2Agent
+	if old {
+		a = k.v1Agent
+	}
+
+	k.mutex.Lock()
+	k.current = a
+	k.mutex.Unlock()
+	return a, nil
+}
+
+// 当前使用的agent，识别集群版本之前为nil
+func (k *Kapp) agent() agent {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.current
+}
+
+func (k *Kapp) isRunning() bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.running
 }
 
-func (k *Kapp) isOldCluster() bool {
+func (k *Kapp) isOldCluster() (bool, error) {
 	flag := true
 	sr, err := k.clientSet.ServerPreferredResources()
-	if err != nil{
-		tool.Log.Error("获取集群资源列表失败...")
-		os.Exit(1)
+	if err != nil {
+		return false, fmt.Errorf("获取集群资源列表失败: %v", err)
 	}
 	for _, i := range sr {
 		if i.GroupVersion == "apps/v1beta2" {
@@ -71,14 +200,13 @@ func (k *Kapp) isOldCluster() bool {
 		}
 	}
 
-	return flag
+	return flag, nil
 }
 
-func (k *Kapp) getVersion() string {
+func (k *Kapp) getVersion() (string, error) {
 	version, err := k.clientSet.ServerVersion()
-	if err != nil{
-		tool.Log.Error("获取集群版本失败...")
-		os.Exit(1)
+	if err != nil {
+		return "", fmt.Errorf("获取集群版本失败: %v", err)
 	}
-	return version.String()
+	return version.String(), nil
 }
@@ -0,0 +1,122 @@
+package kapp
+
+import (
+	"context"
+	"kappagent/util/health"
+	"kappagent/util/tool"
+	"testing"
+	"time"
+)
+
+// 不访问集群的agent，StartRegCluster 返回 reg 的结果
+type fakeAgent struct {
+	tracker *health.Tracker
+	reg     func(ctx context.Context) bool
+}
+
+func (f *fakeAgent) StartRegCluster(ctx context.Context) bool {
+	return f.reg(ctx)
+}
+
+func (f *fakeAgent) Snapshot() (interface{}, error) {
+	return nil, nil
+}
+
+func (f *fakeAgent) Run() error {
+	return nil
+}
+
+func (f *fakeAgent) Close() {}
+
+func (f *fakeAgent) Health() *health.Tracker {
+	return f.tracker
+}
+
+func newTestKapp(a agent, policy RegPolicy) *Kapp {
+	return &Kapp{
+		regPolicy: policy,
+		stop:      make(chan struct{}),
+		current:   a,
+		log:       tool.Log.WithField(tool.FieldCluster, "test"),
+	}
+}
+
+// 注册重试期间watch没有进展也不影响存活
+func TestLiveDuringRegistration(t *testing.T) {
+	a := &fakeAgent{tracker: health.NewTracker([]string{"Node"}, time.Millisecond, nil)}
+	k := newTestKapp(a, RegPolicy{})
+	time.Sleep(5 * time.Millisecond)
+	if ok, status := k.Live(); !ok {
+		t.Fatalf("should be live before watching starts: %+v", status)
+	}
+
+	k.running = true
+	if ok, _ := k.Live(); ok {
+		t.Fatal("stalled watch should fail liveness once running")
+	}
+	a.tracker.Start()
+	if ok, status := k.Live(); !ok {
+		t.Fatalf("progress is counted from the start of watching: %+v", status)
+	}
+}
+
+func TestReadyAfterGivingUp(t *testing.T) {
+	a := &fakeAgent{tracker: health.NewTracker([]string{"Node"}, 0, nil)}
+	a.tracker.WatchEstablished("Node")
+	cases := []struct {
+		name   string
+		giveUp string
+		status RegStatus
+		ready  bool
+	}{
+		{"registering", GiveUpContinue, RegStatus{Attempts: 1}, false},
+		{"registered", GiveUpExit, RegStatus{Registered: true}, true},
+		{"exhausted and continue", GiveUpContinue, RegStatus{Exhausted: true}, true},
+		{"exhausted and exit", GiveUpExit, RegStatus{Exhausted: true}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			k := newTestKapp(a, RegPolicy{GiveUp: c.giveUp})
+			k.regState.status = c.status
+			if ok, status := k.Ready(); ok != c.ready {
+				t.Fatalf("ready = %v, want %v: %+v", ok, c.ready, status)
+			}
+		})
+	}
+}
+
+// 采集卡住时按超时时间放弃这次注册，不等采集结束
+func TestTryRegisterAbandonsOnTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	a := &fakeAgent{reg: func(ctx context.Context) bool {
+		<-release
+		return ctx.Err() == nil
+	}}
+	k := newTestKapp(a, RegPolicy{Timeout: 20 * time.Millisecond})
+
+	done := make(chan error, 1)
+	go func() { done <- k.tryRegister(a) }()
+	select {
+	case err := <-done:
+		if err != errRegTimeout {
+			t.Fatalf("got %v, want %v", err, errRegTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tryRegister waited for the stuck collection")
+	}
+}
+
+func TestTryRegisterStops(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	a := &fakeAgent{reg: func(ctx context.Context) bool {
+		<-release
+		return false
+	}}
+	k := newTestKapp(a, RegPolicy{})
+	close(k.stop)
+	if err := k.tryRegister(a); err != errStopped {
+		t.Fatalf("got %v, want %v", err, errStopped)
+	}
+}
@@ -0,0 +1,66 @@
+package option
+
+import (
+	"kappagent/kapp/inventory"
+	"kappagent/kapp/redact"
+	"kappagent/util/tool"
+	"time"
+)
+
+const (
+	envResyncInterval = "RESYNC_INTERVAL"
+	envResyncHashOnly = "RESYNC_HASH_ONLY"
+	envLiveThreshold  = "LIVENESS_THRESHOLD"
+	envCollectRetries = "COLLECT_RETRIES"
+	envNamespaces     = "WATCH_NAMESPACES"
+	envPayloadMode    = "PAYLOAD_MODE"
+	envDiffBase       = "DIFF_BASE_INTERVAL"
+	envPayloadSchema  = "PAYLOAD_SCHEMA"
+	envCoalesce       = "COALESCE_WINDOW"
+	envSendWorkers    = "SEND_WORKERS"
+)
+
+// agent 的可选配置
+type Options struct {
+	// 全量同步间隔，0表示不做周期全量同步
+	ResyncInterval time.Duration
+	// 数据没有变化时只发送hash
+	ResyncHashOnly bool
+	// watch或发送协程超过该时间没有进展时存活检查失败，0表示不检查
+	LivenessThreshold time.Duration
+	// 调用k8s接口失败时的最大尝试次数
+	CollectRetries int
+	// 只采集这些namespace，为空时采集整个集群
+	Namespaces []string
+	// watch数据的发送模式：full 或 diff
+	PayloadMode string
+	// diff模式下发送完整对象的最长间隔
+	DiffBaseInterval time.Duration
+	// 数据结构：slim 为精简的版本化结构，raw 为完整的k8s对象
+	PayloadSchema string
+	// 同一对象在该时间内的watch事件合并为一个，0表示不合并
+	CoalesceWindow time.Duration
+	// 处理和发送watch事件的协程数，同一对象的事件由同一个协程处理
+	SendWorkers int
+	// 发送前的脱敏规则，nil表示不脱敏
+	Redact *redact.Redactor
+	// 查询接口使用的集群数据，nil表示没有开启查询接口，由kapp按集群设置
+	Inventory *inventory.Store
+}
+
+func NewOptionsFromEnv() Options {
+	return Options{
+		ResyncInterval: tool.EnvDuration(envResyncInterval, 0),
+		ResyncHashOnly: tool.EnvBool(envResyncHashOnly, false),
+		// 需要比watch超时时间(15分钟)长
+		LivenessThreshold: tool.EnvDuration(envLiveThreshold, 30*time.Minute),
+		CollectRetries:    tool.EnvInt(envCollectRetries, 3),
+		Namespaces:        tool.EnvList(envNamespaces),
+		PayloadMode:       tool.EnvString(envPayloadMode, "full"),
+		DiffBaseInterval:  tool.EnvDuration(envDiffBase, 10*time.Minute),
+		PayloadSchema:     tool.EnvString(envPayloadSchema, "slim"),
+		CoalesceWindow:    tool.EnvDuration(envCoalesce, 0),
+		SendWorkers:       tool.EnvInt(envSendWorkers, 1),
+		Redact:            redact.NewFromEnv(),
+	}
+}
@@ -0,0 +1,470 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"hash/fnv"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"kappagent/kapp/coalesce"
+	"kappagent/kapp/diff"
+	"kappagent/kapp/event"
+	"kappagent/kapp/option"
+	"kappagent/kapp/schema"
+	"kappagent/util/health"
+	"kappagent/util/metrics"
+	"kappagent/util/sink"
+	"kappagent/util/tool"
+	"sync"
+	"time"
+)
+
+// 一个watch事件，Data 为各版本agent自己的事件数据。
+// 合并窗口内的事件合并后 Type 可能变化，处理时以这里的 Type 为准
+type Event struct {
+	Resource string
+	Type     watch.EventType
+	Object   metav1.Object
+	Data     interface{}
+}
+
+// diff、合并窗口使用的对象key
+func (e Event) Key() string {
+	return diff.Key(e.Resource, e.Object.GetNamespace(), e.Object.GetName())
+}
+
+// 各版本agent处理事件的函数，seq 为发送数据使用的序号，同一个seq的数据需要按顺序发送
+type ProcessFunc func(e Event, seq *event.Sequencer)
+
+// 可以设置对象hash的完整数据
+type Hashed interface {
+	SetHash(hash string)
+}
+
+// 一次采集的全量数据
+type Project struct {
+	ClusterName string
+	Cloud       string
+	Timestamp   int64
+	Hash        string
+	// 实际发送的数据，按配置为精简或完整结构
+	Payload interface{}
+}
+
+// 周期全量同步时数据没有变化，只发送hash
+type ProjectHash struct {
+	SchemaVersion string `json:"schemaVersion,omitempty"`
+	ClusterName   string `json:"clusterName"`
+	Timestamp     int64  `json:"timestamp"`
+	Cloud         string `json:"cloud"`
+	Resync        bool   `json:"resync"`
+	Unchanged     bool   `json:"unchanged"`
+	Hash          string `json:"hash"`
+	// 序号和幂等key
+	event.Meta
+}
+
+// 与集群版本无关的发送流程：事件合并、发送协程、diff、注册和全量同步。
+// 各版本的agent负责采集数据，以及把事件转换成要发送的数据
+type Pipeline struct {
+	cluster   string
+	cloud     string
+	sink      sink.Sink
+	opt       option.Options
+	health    *health.Tracker
+	log       *logrus.Entry
+	process   ProcessFunc
+	diffs     *diff.Tracker
+	seq       *event.Sequencer
+	coalescer *coalesce.Coalescer
+	workers   []*worker
+
+	mutex    sync.RWMutex
+	lastHash string
+	closed   bool
+	stop     chan struct{}
+	failed   chan error
+	// 转发合并后事件的协程退出后关闭
+	forwarded chan struct{}
+}
+
+// 发送协程，每个协程的数据使用单独的stream，stream内的序号按发送顺序连续递增
+type worker struct {
+	events chan Event
+	seq    *event.Sequencer
+}
+
+func New(cluster, cloud string, s sink.Sink, opt option.Options, tracker *health.Tracker, process ProcessFunc) *Pipeline {
+	p := &Pipeline{
+		cluster: cluster,
+		cloud:   cloud,
+		sink:    s,
+		opt:     opt,
+		health:  tracker,
+		log:     tool.Log.WithField(tool.FieldCluster, cluster),
+		process: process,
+		seq:     event.NewSequencer(cluster),
+		stop:    make(chan struct{}),
+		failed:  make(chan error, 1),
+	}
+	if opt.PayloadMode == diff.ModeDiff {
+		p.diffs = diff.NewTracker(opt.DiffBaseInterval)
+	}
+	if opt.CoalesceWindow > 0 {
+		p.coalescer = coalesce.New(opt.CoalesceWindow)
+	}
+	if opt.SendWorkers > 1 {
+		for i := 0; i < opt.SendWorkers; i++ {
+			p.workers = append(p.workers, &worker{
+				events: make(chan Event, 100),
+				seq:    event.NewSequencer(cluster),
+			})
+		}
+	}
+	return p
+}
+
+// 启动发送协程，协程退出时调用 wg.Done
+func (p *Pipeline) Start(wg *sync.WaitGroup) {
+	for _, w := range p.workers {
+		wg.Add(1)
+		go p.startWorker(w, wg)
+	}
+	if p.coalescer != nil {
+		p.mutex.Lock()
+		p.forwarded = make(chan struct{})
+		p.mutex.Unlock()
+		go p.forward(p.forwarded)
+	}
+}
+
+// 停止后不再处理新的事件，发送协程处理完当前的事件后退出
+func (p *Pipeline) Stop() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.stop)
+	forwarded := p.forwarded
+	p.mutex.Unlock()
+
+	if p.coalescer != nil {
+		p.coalescer.Stop()
+	}
+	// 等转发协程退出后再关闭发送协程的channel
+	if forwarded != nil {
+		<-forwarded
+	}
+	for _, w := range p.workers {
+		close(w.events)
+	}
+}
+
+// 上报协程panic，agent的Run返回这个错误，由调用方重启
+func (p *Pipeline) Fail(r interface{}) {
+	p.log.Error(r)
+	select {
+	case p.failed <- fmt.Errorf("%v", r):
+	default:
+	}
+}
+
+// 第一个上报的panic
+func (p *Pipeline) Failed() <-chan error {
+	return p.failed
+}
+
+func (p *Pipeline) isClosed() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.closed
+}
+
+// 等待发送的事件数
+func (p *Pipeline) Pending() int {
+	n := 0
+	if p.coalescer != nil {
+		n += p.coalescer.Len()
+	}
+	for _, w := range p.workers {
+		n += len(w.events)
+	}
+	return n
+}
+
+// 开启了合并窗口时先合并同一对象的事件，否则直接处理
+func (p *Pipeline) Dispatch(e Event) {
+	if p.coalescer == nil {
+		p.handle(e)
+		return
+	}
+	p.coalescer.Add(e.Key(), e, p.merge)
+}
+
+// 把合并窗口结束的事件按顺序交给发送协程
+func (p *Pipeline) forward(done chan struct{}) {
+	defer close(done)
+	defer func() {
+		if r := recover(); r != nil {
+			p.Fail(r)
+		}
+	}()
+	for {
+		select {
+		case e := <-p.coalescer.C():
+			if p.isClosed() {
+				return
+			}
+			p.handle(e.(Event))
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// 保留最新的对象，事件类型按 coalesce.MergeType 合并，新增后删除的对象不发送
+func (p *Pipeline) merge(old, new interface{}) interface{} {
+	e := new.(Event)
+	metrics.EventsCoalesced.WithLabelValues(p.cluster, e.Resource).Inc()
+	if coalesce.Cancels(old.(Event).Type, e.Type) {
+		return nil
+	}
+	e.Type = coalesce.MergeType(old.(Event).Type, e.Type)
+	return e
+}
+
+// 有发送协程时按对象的key交给固定的协程处理，和diff、合并使用同一个key，
+// 同一对象(包括删除后重建的对象)的事件按顺序发送
+func (p *Pipeline) handle(e Event) {
+	if len(p.workers) == 0 {
+		p.safeProcess(e, p.seq)
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.Key()))
+	p.workers[h.Sum32()%uint32(len(p.workers))].events <- e
+}
+
+// 关闭后剩余的事件直接丢弃
+func (p *Pipeline) startWorker(w *worker, wg *sync.WaitGroup) {
+	for e := range w.events {
+		if !p.isClosed() {
+			p.safeProcess(e, w.seq)
+		}
+	}
+	wg.Done()
+}
+
+// 处理事件时panic只上报，继续处理后面的事件，channel不会因此堵塞
+func (p *Pipeline) safeProcess(e Event, seq *event.Sequencer) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.Fail(r)
+		}
+	}()
+	p.process(e, seq)
+}
+
+// diff模式下只发送对象相对上次版本的patch，其他情况发送完整数据
+// obj 为参与比较的对象，complete 为false(数据不完整)时发送完整数据并在下次重新发送基准
+func (p *Pipeline) SendObject(resource string, object metav1.Object, eventType watch.EventType, obj interface{}, full Hashed, complete bool, seq *event.Sequencer) {
+	var payload interface{} = full
+	if p.diffs == nil {
+		p.send(resource, eventType, payload, object, seq)
+		return
+	}
+
+	key := diff.Key(resource, object.GetNamespace(), object.GetName())
+	if eventType == watch.Deleted || !complete {
+		p.diffs.Forget(key)
+		p.send(resource, eventType, payload, object, seq)
+		return
+	}
+
+	change, err := p.diffs.Compute(key, obj)
+	if err != nil {
+		p.log.WithError(err).WithField(tool.FieldResource, resource).Warn("计算差异失败，发送完整数据")
+		p.diffs.Forget(key)
+		p.send(resource, eventType, payload, object, seq)
+		return
+	}
+	if change.Full {
+		full.SetHash(change.Hash)
+	} else {
+		payload = &diff.Patch{
+			SchemaVersion: p.schemaVersion(),
+			ClusterName:   p.cluster,
+			Timestamp:     time.Now().Unix(),
+			ResourceType:  resource,
+			Type:          eventType,
+			Namespace:     object.GetNamespace(),
+			Name:          object.GetName(),
+			BaseHash:      change.BaseHash,
+			Hash:          change.Hash,
+			Patch:         change.Patch,
+		}
+	}
+	if p.send(resource, eventType, payload, object, seq) {
+		p.diffs.Commit(change)
+	}
+}
+
+// 精简数据结构的版本，发送完整k8s对象时没有版本
+func (p *Pipeline) schemaVersion() string {
+	if p.opt.PayloadSchema == schema.ModeRaw {
+		return ""
+	}
+	return schema.Version
+}
+
+// 设置数据的序号和幂等key
+func stamp(payload interface{}, meta event.Meta) {
+	if s, ok := payload.(interface{ SetMeta(meta event.Meta) }); ok {
+		s.SetMeta(meta)
+	}
+}
+
+// 序列化并发送watch数据，返回是否发送成功
+func (p *Pipeline) send(resource string, eventType watch.EventType, payload interface{}, object metav1.Object, seq *event.Sequencer) bool {
+	defer p.health.SendProgress()
+
+	meta := seq.Event(resource, eventType, object)
+	stamp(payload, meta)
+
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		p.log.WithError(err).WithFields(logrus.Fields{
+			tool.FieldResource: resource,
+			tool.FieldEvent:    eventType,
+		}).Error("序列化数据失败")
+		metrics.EventsDropped.WithLabelValues(p.cluster, resource, string(eventType), metrics.DropMarshal).Inc()
+		return false
+	}
+
+	err = p.sink.Send(&sink.Message{
+		Kind:      sink.KindEvent,
+		Cluster:   p.cluster,
+		Cloud:     p.cloud,
+		ID:        meta.IdempotencyKey,
+		Stream:    meta.Stream,
+		Sequence:  meta.Sequence,
+		Resource:  resource,
+		EventType: eventType,
+		Data:      jsonBytes,
+	})
+	if err != nil {
+		metrics.EventsDropped.WithLabelValues(p.cluster, resource, string(eventType), metrics.DropSendFailed).Inc()
+		return false
+	}
+	return true
+}
+
+// 发送注册数据，ctx 取消后不再发送，正在发送的请求也会中断
+func (p *Pipeline) Register(ctx context.Context, project *Project) bool {
+	meta := p.seq.Project(sink.KindRegister, project.Hash)
+	stamp(project.Payload, meta)
+	jsonBytes, err := json.Marshal(project.Payload)
+	if err != nil {
+		p.log.Error(err)
+		return false
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	success := p.sink.Send(&sink.Message{
+		Kind:     sink.KindRegister,
+		Cluster:  p.cluster,
+		Cloud:    p.cloud,
+		ID:       meta.IdempotencyKey,
+		Stream:   meta.Stream,
+		Sequence: meta.Sequence,
+		Data:     jsonBytes,
+		Context:  ctx,
+	}) == nil
+	if success {
+		p.setLastHash(project.Hash)
+	}
+	return success
+}
+
+// 按 interval 周期全量同步，直到 stop 收到数据
+func (p *Pipeline) RunResync(stop <-chan int, collect func() (*Project, error)) {
+	ticker := time.NewTicker(p.opt.ResyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.resync(collect)
+		case <-stop:
+			p.log.Info("正在关闭全量同步")
+			return
+		}
+	}
+}
+
+func (p *Pipeline) resync(collect func() (*Project, error)) {
+	defer func() {
+		err := recover()
+		if err != nil {
+			p.log.Error(err)
+		}
+	}()
+	p.log.Info("开始周期全量同步...")
+	project, err := collect()
+	if err != nil {
+		return
+	}
+
+	data := project.Payload
+	if p.opt.ResyncHashOnly && project.Hash != "" && project.Hash == p.getLastHash() {
+		p.log.Info("数据没有变化，只发送hash")
+		data = &ProjectHash{
+			SchemaVersion: p.schemaVersion(),
+			ClusterName:   project.ClusterName,
+			Timestamp:     project.Timestamp,
+			Cloud:         project.Cloud,
+			Resync:        true,
+			Unchanged:     true,
+			Hash:          project.Hash,
+		}
+	}
+
+	meta := p.seq.Project(sink.KindResync, project.Hash)
+	stamp(data, meta)
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		p.log.Error(err)
+		return
+	}
+
+	err = p.sink.Send(&sink.Message{
+		Kind:     sink.KindResync,
+		Cluster:  p.cluster,
+		Cloud:    p.cloud,
+		ID:       meta.IdempotencyKey,
+		Stream:   meta.Stream,
+		Sequence: meta.Sequence,
+		Data:     jsonBytes,
+	})
+	if err == nil {
+		p.setLastHash(project.Hash)
+	}
+}
+
+// 上次送达的全量数据的hash
+func (p *Pipeline) getLastHash() string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.lastHash
+}
+
+func (p *Pipeline) setLastHash(hash string) {
+	p.mutex.Lock()
+	p.lastHash = hash
+	p.mutex.Unlock()
+}
@@ -0,0 +1,133 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"kappagent/kapp/diff"
+	"kappagent/kapp/event"
+	"kappagent/kapp/option"
+	"kappagent/kapp/schema"
+	"kappagent/util/health"
+	"kappagent/util/sink"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 事件所在的发送协程
+func (p *Pipeline) testWorker(t *testing.T) int {
+	for i, w := range p.workers {
+		select {
+		case <-w.events:
+			return i
+		default:
+		}
+	}
+	t.Fatal("event was not handed to any worker")
+	return -1
+}
+
+// 删除后重建的对象UID不同，仍然交给同一个发送协程
+func TestHandleShardsByKey(t *testing.T) {
+	p := New("c1", "test", nil, option.Options{SendWorkers: 4}, nil, nil)
+	used := map[int]bool{}
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprint("web-", i)
+		deleted := &metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(fmt.Sprint("old-", i))}
+		added := &metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(fmt.Sprint("new-", i))}
+
+		p.handle(Event{Resource: "Deployment", Type: watch.Deleted, Object: deleted})
+		first := p.testWorker(t)
+		p.handle(Event{Resource: "Deployment", Type: watch.Added, Object: added})
+		if second := p.testWorker(t); second != first {
+			t.Fatalf("%s: recreated object went to worker %d, deleted one to %d", name, second, first)
+		}
+		used[first] = true
+	}
+	if len(used) < 2 {
+		t.Fatal("objects should be spread across workers")
+	}
+}
+
+// 处理事件panic时上报错误，发送协程继续处理后面的事件
+func TestWorkerPanicIsReported(t *testing.T) {
+	processed := make(chan string, 2)
+	p := New("c1", "test", nil, option.Options{SendWorkers: 2}, nil, func(e Event, seq *event.Sequencer) {
+		if e.Object.GetName() == "bad" {
+			panic("bad object")
+		}
+		processed <- e.Object.GetName()
+	})
+	var wg sync.WaitGroup
+	p.Start(&wg)
+
+	p.Dispatch(Event{Resource: "Node", Type: watch.Modified, Object: &metav1.ObjectMeta{Name: "bad"}})
+	p.Dispatch(Event{Resource: "Node", Type: watch.Modified, Object: &metav1.ObjectMeta{Name: "bad"}})
+	p.Dispatch(Event{Resource: "Node", Type: watch.Modified, Object: &metav1.ObjectMeta{Name: "good"}})
+	select {
+	case err := <-p.Failed():
+		if err.Error() != "bad object" {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic was not reported")
+	}
+	select {
+	case name := <-processed:
+		if name != "good" {
+			t.Fatalf("processed %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker stopped after a panic")
+	}
+	p.Stop()
+	wg.Wait()
+}
+
+// 记录发送的数据
+type recordSink struct {
+	messages []*sink.Message
+}
+
+func (r *recordSink) Name() string                 { return "record" }
+func (r *recordSink) Send(msg *sink.Message) error { r.messages = append(r.messages, msg); return nil }
+func (r *recordSink) Close() error                 { return nil }
+
+type node struct {
+	Name   string `json:"name"`
+	Labels string `json:"labels"`
+	Hash   string `json:"hash,omitempty"`
+	event.Meta
+}
+
+func (n *node) SetHash(hash string) { n.Hash = hash }
+
+func (n *node) SetMeta(meta event.Meta) { n.Meta = meta }
+
+// 精简数据结构的patch带有版本，完整k8s对象的patch没有
+func TestPatchSchemaVersion(t *testing.T) {
+	for mode, want := range map[string]string{schema.ModeSlim: schema.Version, schema.ModeRaw: ""} {
+		rec := &recordSink{}
+		opt := option.Options{PayloadMode: diff.ModeDiff, PayloadSchema: mode}
+		p := New("c1", "test", rec, opt, health.NewTracker(nil, 0, nil), nil)
+		object := &metav1.ObjectMeta{Name: "n1"}
+		for _, labels := range []string{"a", "b"} {
+			n := &node{Name: "n1", Labels: labels}
+			p.SendObject("Node", object, watch.Modified, n, n, true, p.seq)
+		}
+
+		var patch map[string]interface{}
+		if err := json.Unmarshal(rec.messages[1].Data, &patch); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := patch["patch"]; !ok {
+			t.Fatalf("%s: second change should be a patch: %s", mode, rec.messages[1].Data)
+		}
+		if got, _ := patch["schemaVersion"].(string); got != want {
+			t.Errorf("%s: schemaVersion = %q, want %q", mode, got, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package rbac
+
+import (
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+)
+
+// agent 需要访问的资源
+type Rule struct {
+	// 资源在上报数据中的名称，如 Deployment
+	Name     string
+	Group    string
+	Resource string
+	Verbs    []string
+	// 是否是namespace级别的资源
+	Namespaced bool
+}
+
+// 单个权限的检查结果
+type Check struct {
+	Name      string `json:"name"`
+	Group     string `json:"group"`
+	Resource  string `json:"resource"`
+	Verb      string `json:"verb"`
+	Namespace string `json:"namespace,omitempty"`
+	Allowed   bool   `json:"allowed"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (c Check) String() string {
+	resource := c.Resource
+	if c.Group != "" {
+		resource += "." + c.Group
+	}
+	if c.Namespace != "" {
+		return fmt.Sprintf("%s %s in %s", c.Verb, resource, c.Namespace)
+	}
+	return fmt.Sprintf("%s %s", c.Verb, resource)
+}
+
+// 权限检查结果，nil 表示没有检查过，所有权限都认为允许
+type Access struct {
+	checks []Check
+}
+
+// 对每条规则的每个动作做 SelfSubjectAccessReview。
+// namespaces 为空时在集群范围检查，否则namespace级别的资源在每个namespace里分别检查
+func SelfCheck(clientSet kubernetes.Interface, rules []Rule, namespaces []string) (*Access, error) {
+	access := &Access{}
+	for _, r := range rules {
+		scopes := []string{metav1.NamespaceAll}
+		if r.Namespaced && len(namespaces) > 0 {
+			scopes = namespaces
+		}
+		for _, namespace := range scopes {
+			for _, verb := range r.Verbs {
+				review, err := clientSet.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+					Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+						ResourceAttributes: &authorizationv1.ResourceAttributes{
+							Namespace: namespace,
+							Verb:      verb,
+							Group:     r.Group,
+							Resource:  r.Resource,
+						},
+					},
+				})
+				if err != nil {
+					return nil, err
+				}
+				access.checks = append(access.checks, Check{
+					Name:      r.Name,
+					Group:     r.Group,
+					Resource:  r.Resource,
+					Verb:      verb,
+					Namespace: namespace,
+					Allowed:   review.Status.Allowed,
+					Reason:    review.Status.Reason,
+				})
+			}
+		}
+	}
+	return access, nil
+}
+
+// name 对应的资源在 namespace 里是否允许 verb 操作，namespace 为空表示集群范围
+func (a *Access) Allowed(name, namespace, verb string) bool {
+	if a == nil {
+		return true
+	}
+	for _, c := range a.checks {
+		if c.Name != name || c.Verb != verb || c.Allowed {
+			continue
+		}
+		if c.Namespace == metav1.NamespaceAll || c.Namespace == namespace {
+			return false
+		}
+	}
+	return true
+}
+
+// 缺少的权限
+func (a *Access) Denied() []Check {
+	if a == nil {
+		return nil
+	}
+	var denied []Check
+	for _, c := range a.checks {
+		if !c.Allowed {
+			denied = append(denied, c)
+		}
+	}
+	return denied
+}
+
+func (a *Access) DeniedStrings() []string {
+	var denied []string
+	for _, c := range a.Denied() {
+		denied = append(denied, c.String())
+	}
+	return denied
+}
+
+// 根据规则生成最小权限的 ClusterRole
+func ClusterRole(name string, rules []Rule) *rbacv1.ClusterRole {
+	type key struct{ group, resource string }
+	verbs := map[key]map[string]bool{}
+	for _, r := range rules {
+		k := key{r.Group, r.Resource}
+		if verbs[k] == nil {
+			verbs[k] = map[string]bool{}
+		}
+		for _, v := range r.Verbs {
+			verbs[k][v] = true
+		}
+	}
+
+	var policyRules []rbacv1.PolicyRule
+	for k, vs := range verbs {
+		var list []string
+		for v := range vs {
+			list = append(list, v)
+		}
+		sort.Strings(list)
+		policyRules = append(policyRules, rbacv1.PolicyRule{
+			APIGroups: []string{k.group},
+			Resources: []string{k.resource},
+			Verbs:     list,
+		})
+	}
+	sort.Slice(policyRules, func(i, j int) bool {
+		a, b := policyRules[i], policyRules[j]
+		if a.APIGroups[0] != b.APIGroups[0] {
+			return a.APIGroups[0] < b.APIGroups[0]
+		}
+		return a.Resources[0] < b.Resources[0]
+	})
+
+	return &rbacv1.ClusterRole{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "rbac.authorization.k8s.io/v1",
+			Kind:       "ClusterRole",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Rules: policyRules,
+	}
+}
+
+// ClusterRole 的 yaml，去掉空的 creationTimestamp
+func ClusterRoleYAML(name string, rules []Rule) (string, error) {
+	out, err := yaml.Marshal(ClusterRole(name, rules))
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(string(out), "  creationTimestamp: null\n", "", 1), nil
+}
@@ -0,0 +1,197 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"kappagent/util/tool"
+	"regexp"
+	"strings"
+)
+
+const (
+	envRedactEnv         = "REDACT_ENV"
+	envRedactEnvNames    = "REDACT_ENV_NAMES"
+	envRedactAnnotations = "REDACT_ANNOTATIONS"
+	envRedactArgs        = "REDACT_ARGS"
+	envRedactHashKey     = "REDACT_HASH_KEY"
+
+	// env值的处理方式
+	EnvKeep = "keep"
+	EnvDrop = "drop"
+	EnvHash = "hash"
+
+	// 被屏蔽的annotation的值
+	Masked = "***"
+
+	// kubectl apply 记录的完整manifest，包含env的明文
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// 发送前对k8s对象脱敏
+type Redactor struct {
+	// env值的处理方式：keep、drop 或 hash
+	EnvMode string
+	// hash 使用的HMAC密钥，每个部署单独配置，接收方无法通过字典还原常见的值
+	HashKey []byte
+	// 只处理名称匹配的env，为空时处理所有env
+	EnvNames []*regexp.Regexp
+	// 值需要屏蔽的annotation
+	Annotations []*regexp.Regexp
+	// 匹配的命令行参数会被去掉
+	Args []*regexp.Regexp
+}
+
+// 没有配置任何规则时返回nil
+func NewFromEnv() *Redactor {
+	r := &Redactor{
+		EnvMode:     tool.EnvString(envRedactEnv, EnvKeep),
+		EnvNames:    patterns(envRedactEnvNames),
+		Annotations: patterns(envRedactAnnotations),
+		Args:        patterns(envRedactArgs),
+		HashKey:     []byte(tool.EnvString(envRedactHashKey, "")),
+	}
+	switch r.EnvMode {
+	case EnvKeep, EnvDrop:
+	case EnvHash:
+		if len(r.HashKey) == 0 {
+			tool.Log.Warnf("没有设置环境变量 %s，env的值直接去掉", envRedactHashKey)
+			r.EnvMode = EnvDrop
+		}
+	default:
+		tool.Log.Warnf("环境变量 %s=%s 不合法，不处理env", envRedactEnv, r.EnvMode)
+		r.EnvMode = EnvKeep
+	}
+	if r.EnvMode == EnvKeep && len(r.Annotations) == 0 && len(r.Args) == 0 {
+		return nil
+	}
+	// 不屏蔽的话env、参数和其他annotation的明文会通过这个annotation发送出去
+	r.Annotations = append(r.Annotations, regexp.MustCompile("^"+regexp.QuoteMeta(lastAppliedAnnotation)+"$"))
+	return r
+}
+
+// 逗号分隔的正则，格式错误的忽略
+func patterns(name string) []*regexp.Regexp {
+	var list []*regexp.Regexp
+	for _, p := range tool.EnvList(name) {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			tool.Log.WithError(err).Warnf("环境变量 %s 中的正则 %s 不合法，忽略", name, p)
+			continue
+		}
+		list = append(list, re)
+	}
+	return list
+}
+
+func (r *Redactor) Meta(meta *metav1.ObjectMeta) {
+	if r == nil {
+		return
+	}
+	for k := range meta.Annotations {
+		if match(r.Annotations, k) {
+			meta.Annotations[k] = Masked
+		}
+	}
+}
+
+func (r *Redactor) PodTemplate(t *corev1.PodTemplateSpec) {
+	if r == nil {
+		return
+	}
+	r.Meta(&t.ObjectMeta)
+	r.PodSpec(&t.Spec)
+}
+
+func (r *Redactor) Pod(p *corev1.Pod) {
+	if r == nil {
+		return
+	}
+	r.Meta(&p.ObjectMeta)
+	r.PodSpec(&p.Spec)
+}
+
+func (r *Redactor) Node(n *corev1.Node) {
+	if r == nil {
+		return
+	}
+	r.Meta(&n.ObjectMeta)
+}
+
+func (r *Redactor) PodSpec(spec *corev1.PodSpec) {
+	if r == nil {
+		return
+	}
+	for i := range spec.InitContainers {
+		r.Container(&spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		r.Container(&spec.Containers[i])
+	}
+}
+
+func (r *Redactor) Container(c *corev1.Container) {
+	if r == nil {
+		return
+	}
+	c.Command = r.stripArgs(c.Command)
+	c.Args = r.stripArgs(c.Args)
+	if r.EnvMode == EnvKeep {
+		return
+	}
+
+	// 使用新的slice，pod中的容器和单独复制的容器共用底层数组
+	env := make([]corev1.EnvVar, 0, len(c.Env))
+	for _, e := range c.Env {
+		// valueFrom 只是引用，没有明文
+		if e.Value == "" || len(r.EnvNames) > 0 && !match(r.EnvNames, e.Name) {
+			env = append(env, e)
+			continue
+		}
+		if r.EnvMode == EnvHash && len(r.HashKey) > 0 {
+			e.Value = r.hash(e.Value)
+			env = append(env, e)
+		}
+	}
+	c.Env = env
+}
+
+// 去掉匹配的参数。匹配的是不带'='的选项(如 --password)时，后面的值也一起去掉
+func (r *Redactor) stripArgs(args []string) []string {
+	if len(r.Args) == 0 || len(args) == 0 {
+		return args
+	}
+	kept := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !match(r.Args, a) {
+			kept = append(kept, a)
+			continue
+		}
+		if isFlag(a) && !strings.Contains(a, "=") && i+1 < len(args) && !isFlag(args[i+1]) {
+			i++
+		}
+	}
+	return kept
+}
+
+func isFlag(arg string) bool {
+	return strings.HasPrefix(arg, "-")
+}
+
+func match(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redactor) hash(s string) string {
+	mac := hmac.New(sha256.New, r.HashKey)
+	mac.Write([]byte(s))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,143 @@
+package redact
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func res(s ...string) []*regexp.Regexp {
+	var list []*regexp.Regexp
+	for _, p := range s {
+		list = append(list, regexp.MustCompile(p))
+	}
+	return list
+}
+
+func env() []corev1.EnvVar {
+	return []corev1.EnvVar{
+		{Name: "DB_PASSWORD", Value: "secret"},
+		{Name: "LOG_LEVEL", Value: "info"},
+		{Name: "TOKEN", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{Key: "token"}}},
+	}
+}
+
+func TestEnv(t *testing.T) {
+	cases := []struct {
+		name  string
+		r     *Redactor
+		names []string
+		// 保留下来的值，空字符串表示 valueFrom
+		values []string
+	}{
+		{"keep", &Redactor{EnvMode: EnvKeep}, []string{"DB_PASSWORD", "LOG_LEVEL", "TOKEN"}, []string{"secret", "info", ""}},
+		{"drop all", &Redactor{EnvMode: EnvDrop}, []string{"TOKEN"}, []string{""}},
+		{"drop matching", &Redactor{EnvMode: EnvDrop, EnvNames: res("PASSWORD$")}, []string{"LOG_LEVEL", "TOKEN"}, []string{"info", ""}},
+		{"hash matching", &Redactor{EnvMode: EnvHash, HashKey: []byte("k1"), EnvNames: res("PASSWORD$")}, []string{"DB_PASSWORD", "LOG_LEVEL", "TOKEN"}, []string{"hmac", "info", ""}},
+		{"hash without key", &Redactor{EnvMode: EnvHash}, []string{"TOKEN"}, []string{""}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			original := env()
+			container := corev1.Container{Env: original}
+			c.r.Container(&container)
+
+			var names, values []string
+			for _, e := range container.Env {
+				names = append(names, e.Name)
+				v := e.Value
+				if strings.HasPrefix(v, "hmac-sha256:") {
+					v = "hmac"
+				}
+				values = append(values, v)
+			}
+			if !reflect.DeepEqual(names, c.names) || !reflect.DeepEqual(values, c.values) {
+				t.Fatalf("got %v %v, want %v %v", names, values, c.names, c.values)
+			}
+			// 不修改原来的对象
+			if !reflect.DeepEqual(original, env()) {
+				t.Fatalf("original env was modified: %v", original)
+			}
+		})
+	}
+}
+
+// 相同的值在同一个密钥下hash相同，不同密钥下不同，也不是无盐的sha256
+func TestHashKey(t *testing.T) {
+	a := &Redactor{EnvMode: EnvHash, HashKey: []byte("k1")}
+	b := &Redactor{EnvMode: EnvHash, HashKey: []byte("k2")}
+	if a.hash("secret") != a.hash("secret") {
+		t.Fatal("hash is not stable")
+	}
+	if a.hash("secret") == b.hash("secret") {
+		t.Fatal("different keys should give different hashes")
+	}
+	// sha256("secret")
+	if strings.Contains(a.hash("secret"), "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b") {
+		t.Fatal("hash should not be a plain sha256")
+	}
+}
+
+func TestStripArgs(t *testing.T) {
+	r := &Redactor{Args: res("^--password", "^--token=")}
+	cases := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"equals form", []string{"app", "--password=x", "--port=80"}, []string{"app", "--port=80"}},
+		{"separate value", []string{"app", "--password", "x", "--port", "80"}, []string{"app", "--port", "80"}},
+		{"flag followed by flag", []string{"app", "--password", "--verbose"}, []string{"app", "--verbose"}},
+		{"last flag", []string{"app", "--password"}, []string{"app"}},
+		{"value flag only with equals", []string{"--token=abc", "--token", "abc"}, []string{"--token", "abc"}},
+		{"no match", []string{"app", "--port=80"}, []string{"app", "--port=80"}},
+		{"empty", nil, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := r.stripArgs(c.in)
+			if len(got) == 0 && len(c.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	r := &Redactor{Annotations: res("^secret/", "^"+regexp.QuoteMeta(lastAppliedAnnotation)+"$")}
+	meta := metav1.ObjectMeta{Annotations: map[string]string{
+		lastAppliedAnnotation: `{"spec":{"env":[{"name":"DB_PASSWORD","value":"secret"}]}}`,
+		"secret/key":          "value",
+		"team":                "a",
+	}}
+	r.Meta(&meta)
+	want := map[string]string{lastAppliedAnnotation: Masked, "secret/key": Masked, "team": "a"}
+	if !reflect.DeepEqual(meta.Annotations, want) {
+		t.Fatalf("got %v, want %v", meta.Annotations, want)
+	}
+}
+
+// 配置了任何规则时都会屏蔽 last-applied annotation
+func TestNewFromEnvMasksLastApplied(t *testing.T) {
+	t.Setenv(envRedactArgs, "^--password")
+	r := NewFromEnv()
+	if r == nil || !match(r.Annotations, lastAppliedAnnotation) {
+		t.Fatalf("last-applied annotation should be masked: %+v", r)
+	}
+
+	t.Setenv(envRedactArgs, "")
+	t.Setenv(envRedactEnv, EnvHash)
+	if r := NewFromEnv(); r == nil || r.EnvMode != EnvDrop {
+		t.Fatalf("hash without %s should drop the values: %+v", envRedactHashKey, r)
+	}
+	t.Setenv(envRedactHashKey, "k1")
+	if r := NewFromEnv(); r == nil || r.EnvMode != EnvHash {
+		t.Fatalf("hash with a key should be kept: %+v", r)
+	}
+}
@@ -0,0 +1,171 @@
+package kapp
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"kappagent/util/backoff"
+	"kappagent/util/tool"
+	"sync"
+	"time"
+)
+
+const (
+	envRegBackoffInitial = "REG_BACKOFF_INITIAL"
+	envRegBackoffMax     = "REG_BACKOFF_MAX"
+	envRegTimeout        = "REG_TIMEOUT"
+	envRegMaxAttempts    = "REG_MAX_ATTEMPTS"
+	envRegGiveUp         = "REG_GIVE_UP"
+
+	// 注册次数用尽后退出进程，交给k8s重启
+	GiveUpExit = "exit"
+	// 注册次数用尽后不再注册，直接开始watch
+	GiveUpContinue = "continue"
+)
+
+var (
+	errRegTimeout   = errors.New("注册超时")
+	errRegFailed    = errors.New("注册失败")
+	errRegExhausted = errors.New("注册次数用尽")
+	errStopped      = errors.New("已关闭")
+)
+
+// 注册策略
+type RegPolicy struct {
+	BackoffInitial time.Duration
+	BackoffMax     time.Duration
+	Timeout        time.Duration
+	// 最大尝试次数，0表示不限制
+	MaxAttempts int
+	GiveUp      string
+}
+
+func NewRegPolicyFromEnv() RegPolicy {
+	return RegPolicy{
+		BackoffInitial: tool.EnvDuration(envRegBackoffInitial, time.Second),
+		BackoffMax:     tool.EnvDuration(envRegBackoffMax, 5*time.Minute),
+		Timeout:        tool.EnvDuration(envRegTimeout, 2*time.Minute),
+		MaxAttempts:    tool.EnvInt(envRegMaxAttempts, 0),
+		GiveUp:         tool.EnvString(envRegGiveUp, GiveUpExit),
+	}
+}
+
+// 注册状态，供健康检查使用
+type RegStatus struct {
+	Registered  bool      `json:"registered"`
+	Exhausted   bool      `json:"exhausted"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+type regState struct {
+	mutex  sync.RWMutex
+	status RegStatus
+}
+
+func (r *regState) get() RegStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.status
+}
+
+func (r *regState) update(f func(s *RegStatus)) {
+	r.mutex.Lock()
+	f(&r.status)
+	r.mutex.Unlock()
+}
+
+// 带退避的注册循环，注册成功或按策略放弃注册后返回nil
+// 被关闭时返回errStopped，次数用尽且策略为exit时返回errRegExhausted
+func (k *Kapp) register(a agent) error {
+	b := backoff.NewBackoff(k.regPolicy.BackoffInitial, k.regPolicy.BackoffMax)
+
+	for attempt := 1; ; attempt++ {
+		k.regState.update(func(s *RegStatus) {
+			s.Attempts = attempt
+			s.LastAttempt = time.Now()
+		})
+
+		err := k.tryRegister(a)
+		if err == errStopped {
+			return err
+		}
+		if err == nil {
+			k.regState.update(func(s *RegStatus) {
+				s.Registered = true
+				s.LastError = ""
+				s.NextAttempt = time.Time{}
+			})
+			return nil
+		}
+
+		if k.regPolicy.MaxAttempts > 0 && attempt >= k.regPolicy.MaxAttempts {
+			k.log.WithField("attempts", attempt).Error(errRegExhausted)
+			k.regState.update(func(s *RegStatus) {
+				s.Exhausted = true
+				s.LastError = err.Error()
+			})
+			if k.regPolicy.GiveUp == GiveUpContinue {
+				return nil
+			}
+			return errRegExhausted
+		}
+
+		wait := b.Duration(attempt)
+		k.log.WithError(err).WithFields(logrus.Fields{
+			"attempt": attempt,
+			"wait":    wait.String(),
+		}).Warn("注册失败，稍后重试")
+		k.regState.update(func(s *RegStatus) {
+			s.LastError = err.Error()
+			s.NextAttempt = time.Now().Add(wait)
+		})
+
+		select {
+		case <-time.After(wait):
+		case <-k.stop:
+			return errStopped
+		}
+	}
+}
+
+// 单次注册，超过超时时间视为失败。超时包括检查权限、列举资源等采集步骤，
+// 这些请求不能取消，超时或关闭时不再等待，这次注册的结果直接丢弃
+func (k *Kapp) tryRegister(a agent) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	if k.regPolicy.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), k.regPolicy.Timeout)
+	}
+	defer cancel()
+
+	// 有缓冲，放弃等待后协程也能退出
+	result := make(chan bool, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				k.log.Error(err)
+				result <- false
+			}
+		}()
+		// 采集结束时已经超时则不再发送
+		result <- a.StartRegCluster(ctx)
+	}()
+
+	var success bool
+	select {
+	case success = <-result:
+	case <-ctx.Done():
+		return errRegTimeout
+	case <-k.stop:
+		return errStopped
+	}
+	if success {
+		return nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errRegTimeout
+	}
+	return errRegFailed
+}
@@ -0,0 +1,155 @@
+package schema
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// 不同api版本的Deployment、StatefulSet中需要的字段，由v1、v2 agent填充
+type WorkloadSource struct {
+	Kind               string
+	Meta               metav1.ObjectMeta
+	Replicas           *int32
+	Selector           *metav1.LabelSelector
+	Template           corev1.PodTemplateSpec
+	ReadyReplicas      int32
+	UpdatedReplicas    int32
+	AvailableReplicas  int32
+	ObservedGeneration int64
+}
+
+// 返回的Workload中Pods为空，由调用方添加
+func NewWorkload(src WorkloadSource) Workload {
+	w := Workload{
+		Kind:               src.Kind,
+		Namespace:          src.Meta.Namespace,
+		Name:               src.Meta.Name,
+		UID:                string(src.Meta.UID),
+		ResourceVersion:    src.Meta.ResourceVersion,
+		CreationTimestamp:  unix(src.Meta.CreationTimestamp),
+		Labels:             src.Meta.Labels,
+		ReadyReplicas:      src.ReadyReplicas,
+		UpdatedReplicas:    src.UpdatedReplicas,
+		AvailableReplicas:  src.AvailableReplicas,
+		Generation:         src.Meta.Generation,
+		ObservedGeneration: src.ObservedGeneration,
+		Containers:         newContainers(src.Template.Spec.Containers, nil),
+		Pods:               []Pod{},
+	}
+	if src.Replicas != nil {
+		w.Replicas = *src.Replicas
+	}
+	if src.Selector != nil {
+		w.Selector = src.Selector.MatchLabels
+	}
+	return w
+}
+
+func NewPod(p *corev1.Pod) Pod {
+	pod := Pod{
+		Name:              p.Name,
+		UID:               string(p.UID),
+		ResourceVersion:   p.ResourceVersion,
+		CreationTimestamp: unix(p.CreationTimestamp),
+		Labels:            p.Labels,
+		NodeName:          p.Spec.NodeName,
+		HostIP:            p.Status.HostIP,
+		PodIP:             p.Status.PodIP,
+		Phase:             string(p.Status.Phase),
+		Containers:        newContainers(p.Spec.Containers, p.Status.ContainerStatuses),
+	}
+	if p.Status.StartTime != nil {
+		pod.StartTime = unix(*p.Status.StartTime)
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			pod.Ready = c.Status == corev1.ConditionTrue
+		}
+	}
+	return pod
+}
+
+func NewNode(n *corev1.Node) Node {
+	node := Node{
+		Name:              n.Name,
+		UID:               string(n.UID),
+		ResourceVersion:   n.ResourceVersion,
+		CreationTimestamp: unix(n.CreationTimestamp),
+		Labels:            n.Labels,
+		Addresses:         []Address{},
+		Unschedulable:     n.Spec.Unschedulable,
+		Capacity:          quantities(n.Status.Capacity),
+		Allocatable:       quantities(n.Status.Allocatable),
+		KubeletVersion:    n.Status.NodeInfo.KubeletVersion,
+		OSImage:           n.Status.NodeInfo.OSImage,
+		KernelVersion:     n.Status.NodeInfo.KernelVersion,
+		ContainerRuntime:  n.Status.NodeInfo.ContainerRuntimeVersion,
+		Architecture:      n.Status.NodeInfo.Architecture,
+	}
+	for _, a := range n.Status.Addresses {
+		node.Addresses = append(node.Addresses, Address{Type: string(a.Type), Address: a.Address})
+	}
+	for _, c := range n.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			node.Ready = c.Status == corev1.ConditionTrue
+		}
+	}
+	return node
+}
+
+// statuses 为空时只有spec中的字段
+func newContainers(containers []corev1.Container, statuses []corev1.ContainerStatus) []Container {
+	cs := make([]Container, 0, len(containers))
+	for _, c := range containers {
+		container := Container{
+			Name:     c.Name,
+			Image:    c.Image,
+			Requests: quantities(c.Resources.Requests),
+			Limits:   quantities(c.Resources.Limits),
+		}
+		for _, p := range c.Ports {
+			container.Ports = append(container.Ports, Port{
+				Name:          p.Name,
+				ContainerPort: p.ContainerPort,
+				Protocol:      string(p.Protocol),
+			})
+		}
+		for _, s := range statuses {
+			if s.Name != c.Name {
+				continue
+			}
+			container.Ready = s.Ready
+			container.Restarts = s.RestartCount
+			container.ImageID = s.ImageID
+			switch {
+			case s.State.Running != nil:
+				container.State = "running"
+				container.StartedAt = unix(s.State.Running.StartedAt)
+			case s.State.Waiting != nil:
+				container.State = "waiting"
+			case s.State.Terminated != nil:
+				container.State = "terminated"
+			}
+		}
+		cs = append(cs, container)
+	}
+	return cs
+}
+
+func quantities(list corev1.ResourceList) map[string]string {
+	if len(list) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(list))
+	for name, q := range list {
+		m[string(name)] = q.String()
+	}
+	return m
+}
+
+func unix(t metav1.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
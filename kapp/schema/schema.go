@@ -0,0 +1,192 @@
+package schema
+
+import (
+	"k8s.io/apimachinery/pkg/watch"
+	"kappagent/kapp/collect"
+	"kappagent/kapp/event"
+	"kappagent/kapp/rbac"
+	"kappagent/util/tool"
+)
+
+// 精简数据结构的版本，字段有不兼容的变化时增加
+// 对应的 JSON Schema 见 schema/payload.schema.json
+const Version = "1"
+
+// 数据结构模式
+const (
+	// 只包含接收方使用的字段
+	ModeSlim = "slim"
+	// 完整的k8s对象
+	ModeRaw = "raw"
+)
+
+// 集群全量数据
+type Project struct {
+	SchemaVersion      string            `json:"schemaVersion"`
+	ClusterName        string            `json:"clusterName"`
+	Timestamp          int64             `json:"timestamp"`
+	Cloud              string            `json:"cloud"`
+	Resync             bool              `json:"resync"`
+	Hash               string            `json:"hash"`
+	Namespaces         []Namespace       `json:"namespaces"`
+	Nodes              []Node            `json:"nodes"`
+	Partial            bool              `json:"partial"`
+	Failures           []collect.Failure `json:"failures,omitempty"`
+	MissingPermissions []rbac.Check      `json:"missingPermissions,omitempty"`
+	PartialScope       bool              `json:"partialScope"`
+	ScopeNamespaces    []string          `json:"scopeNamespaces,omitempty"`
+	event.Meta
+}
+
+type Namespace struct {
+	Name         string     `json:"name"`
+	Deployments  []Workload `json:"deployments"`
+	StatefulSets []Workload `json:"statefulsets"`
+}
+
+// Deployment 或 StatefulSet
+type Workload struct {
+	Kind              string            `json:"kind"`
+	Namespace         string            `json:"namespace"`
+	Name              string            `json:"name"`
+	UID               string            `json:"uid"`
+	ResourceVersion   string            `json:"resourceVersion"`
+	CreationTimestamp int64             `json:"creationTimestamp"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Selector          map[string]string `json:"selector,omitempty"`
+	Replicas          int32             `json:"replicas"`
+	ReadyReplicas     int32             `json:"readyReplicas"`
+	UpdatedReplicas   int32             `json:"updatedReplicas"`
+	// 只有Deployment有
+	AvailableReplicas  int32       `json:"availableReplicas"`
+	Generation         int64       `json:"generation"`
+	ObservedGeneration int64       `json:"observedGeneration"`
+	Containers         []Container `json:"containers"`
+	Pods               []Pod       `json:"pods"`
+}
+
+type Container struct {
+	Name      string            `json:"name"`
+	Image     string            `json:"image"`
+	Ports     []Port            `json:"ports,omitempty"`
+	Requests  map[string]string `json:"requests,omitempty"`
+	Limits    map[string]string `json:"limits,omitempty"`
+	Ready     bool              `json:"ready"`
+	Restarts  int32             `json:"restarts"`
+	State     string            `json:"state,omitempty"`
+	ImageID   string            `json:"imageID,omitempty"`
+	StartedAt int64             `json:"startedAt,omitempty"`
+}
+
+type Port struct {
+	Name          string `json:"name,omitempty"`
+	ContainerPort int32  `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+type Pod struct {
+	Name              string            `json:"name"`
+	UID               string            `json:"uid"`
+	ResourceVersion   string            `json:"resourceVersion"`
+	CreationTimestamp int64             `json:"creationTimestamp"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	NodeName          string            `json:"nodeName"`
+	HostIP            string            `json:"hostIP"`
+	PodIP             string            `json:"podIP"`
+	Phase             string            `json:"phase"`
+	Ready             bool              `json:"ready"`
+	StartTime         int64             `json:"startTime,omitempty"`
+	Containers        []Container       `json:"containers"`
+}
+
+type Node struct {
+	Name              string            `json:"name"`
+	UID               string            `json:"uid"`
+	ResourceVersion   string            `json:"resourceVersion"`
+	CreationTimestamp int64             `json:"creationTimestamp"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Addresses         []Address         `json:"addresses"`
+	Ready             bool              `json:"ready"`
+	Unschedulable     bool              `json:"unschedulable"`
+	Capacity          map[string]string `json:"capacity,omitempty"`
+	Allocatable       map[string]string `json:"allocatable,omitempty"`
+	KubeletVersion    string            `json:"kubeletVersion"`
+	OSImage           string            `json:"osImage"`
+	KernelVersion     string            `json:"kernelVersion"`
+	ContainerRuntime  string            `json:"containerRuntime"`
+	Architecture      string            `json:"architecture"`
+}
+
+type Address struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+// Deployment、StatefulSet 的watch数据
+type WatchProject struct {
+	SchemaVersion string            `json:"schemaVersion"`
+	ClusterName   string            `json:"clusterName"`
+	Timestamp     int64             `json:"timestamp"`
+	ResourceType  string            `json:"resourceType"`
+	Type          watch.EventType   `json:"type"`
+	Namespaces    []Namespace       `json:"namespaces"`
+	Failures      []collect.Failure `json:"failures,omitempty"`
+	Hash          string            `json:"hash,omitempty"`
+	event.Meta
+}
+
+func (w *WatchProject) SetHash(hash string) {
+	w.Hash = hash
+}
+
+// Node 的watch数据
+type WatchNode struct {
+	SchemaVersion string          `json:"schemaVersion"`
+	ClusterName   string          `json:"clusterName"`
+	Timestamp     int64           `json:"timestamp"`
+	ResourceType  string          `json:"resourceType"`
+	Type          watch.EventType `json:"type"`
+	Node          Node            `json:"node"`
+	Hash          string          `json:"hash,omitempty"`
+	event.Meta
+}
+
+func (w *WatchNode) SetHash(hash string) {
+	w.Hash = hash
+}
+
+// 全量数据中参与hash的部分
+type hashContent struct {
+	ClusterName string      `json:"clusterName"`
+	Cloud       string      `json:"cloud"`
+	Namespaces  []Namespace `json:"namespaces"`
+	Nodes       []Node      `json:"nodes"`
+}
+
+// 计算全量数据内容的hash。精简数据结构中没有心跳、状态更新时间这类字段，
+// 再去掉每次写入都会变化的resourceVersion，只有内容变化时hash才会变化。
+// namespaces、nodes 需要是新生成的数据，其中的resourceVersion会被清空
+func ProjectHash(clusterName, cloud string, namespaces []Namespace, nodes []Node) (string, error) {
+	for i := range namespaces {
+		clearWorkloadVersions(namespaces[i].Deployments)
+		clearWorkloadVersions(namespaces[i].StatefulSets)
+	}
+	for i := range nodes {
+		nodes[i].ResourceVersion = ""
+	}
+	return tool.ContentHash(&hashContent{
+		ClusterName: clusterName,
+		Cloud:       cloud,
+		Namespaces:  namespaces,
+		Nodes:       nodes,
+	})
+}
+
+func clearWorkloadVersions(workloads []Workload) {
+	for i := range workloads {
+		workloads[i].ResourceVersion = ""
+		for q := range workloads[i].Pods {
+			workloads[i].Pods[q].ResourceVersion = ""
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package v1
+
+import (
+	"k8s.io/apimachinery/pkg/watch"
+	"kappagent/kapp/pipeline"
+	"kappagent/kapp/schema"
+)
+
+// 根据配置返回精简或完整的全量数据
+func (v1 *Agent) payload(project *Project) interface{} {
+	if v1.opt.PayloadSchema == schema.ModeRaw {
+		return project
+	}
+	return slimProject(project)
+}
+
+// 注册和全量同步发送的数据
+func (v1 *Agent) pipelineProject(project *Project) *pipeline.Project {
+	return &pipeline.Project{
+		ClusterName: project.ClusterName,
+		Cloud:       project.Cloud,
+		Timestamp:   project.Timestamp,
+		Hash:        project.Hash,
+		Payload:     v1.payload(project),
+	}
+}
+
+// 根据配置返回watch数据，以及diff模式下参与比较的对象
+func (v1 *Agent) watchPayload(w *WatchProject) (interface{}, pipeline.Hashed) {
+	if v1.opt.PayloadSchema == schema.ModeRaw {
+		return rawObject(w.Namespaces[0]), w
+	}
+	s := &schema.WatchProject{
+		SchemaVersion: schema.Version,
+		ClusterName:   w.ClusterName,
+		Timestamp:     w.Timestamp,
+		ResourceType:  w.ResourceType,
+		Type:          w.Type,
+		Namespaces:    slimNamespaces(w.Namespaces),
+		Failures:      w.Failures,
+	}
+	return slimObject(s.Namespaces[0]), s
+}
+
+func (v1 *Agent) watchNodePayload(w *WatchNode) (interface{}, pipeline.Hashed) {
+	if v1.opt.PayloadSchema == schema.ModeRaw {
+		return &w.Node, w
+	}
+	s := &schema.WatchNode{
+		SchemaVersion: schema.Version,
+		ClusterName:   w.ClusterName,
+		Timestamp:     w.Timestamp,
+		ResourceType:  w.ResourceType,
+		Type:          w.Type,
+		Node:          schema.NewNode(&w.Node),
+	}
+	return &s.Node, s
+}
+
+// 更新查询接口使用的数据，始终使用精简数据结构
+func (v1 *Agent) inventoryProject(project *Project) {
+	if v1.opt.Inventory != nil {
+		v1.opt.Inventory.Replace(slimProject(project))
+	}
+}
+
+func (v1 *Agent) inventoryWorkload(w *WatchProject, complete bool) {
+	if v1.opt.Inventory == nil {
+		return
+	}
+	workload := slimObject(slimNamespaces(w.Namespaces)[0]).(*schema.Workload)
+	if w.Type == watch.Deleted {
+		v1.opt.Inventory.DeleteWorkload(workload.Kind, workload.Namespace, workload.Name)
+		return
+	}
+	v1.opt.Inventory.UpsertWorkload(*workload, complete)
+}
+
+func (v1 *Agent) inventoryNode(w *WatchNode) {
+	if v1.opt.Inventory == nil {
+		return
+	}
+	if w.Type == watch.Deleted {
+		v1.opt.Inventory.DeleteNode(w.Node.Name)
+		return
+	}
+	v1.opt.Inventory.UpsertNode(schema.NewNode(&w.Node))
+}
+
+// watch数据中只有一个对象
+func rawObject(ns Namespace) interface{} {
+	if len(ns.Deployments) > 0 {
+		return &ns.Deployments[0]
+	}
+	return &ns.StatefulSets[0]
+}
+
+func slimObject(ns schema.Namespace) interface{} {
+	if len(ns.Deployments) > 0 {
+		return &ns.Deployments[0]
+	}
+	return &ns.StatefulSets[0]
+}
+
+func slimProject(p *Project) *schema.Project {
+	s := &schema.Project{
+		SchemaVersion:      schema.Version,
+		ClusterName:        p.ClusterName,
+		Timestamp:          p.Timestamp,
+		Cloud:              p.Cloud,
+		Resync:             p.Resync,
+		Hash:               p.Hash,
+		Namespaces:         slimNamespaces(p.Namespaces),
+		Nodes:              make([]schema.Node, 0, len(p.Nodes)),
+		Partial:            p.Partial,
+		Failures:           p.Failures,
+		MissingPermissions: p.MissingPermissions,
+		PartialScope:       p.PartialScope,
+		ScopeNamespaces:    p.ScopeNamespaces,
+	}
+	for i := range p.Nodes {
+		s.Nodes = append(s.Nodes, schema.NewNode(&p.Nodes[i]))
+	}
+	return s
+}
+
+func slimNamespaces(namespaces []Namespace) []schema.Namespace {
+	list := make([]schema.Namespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		n := schema.Namespace{
+			Name:         ns.Name,
+			Deployments:  make([]schema.Workload, 0, len(ns.Deployments)),
+			StatefulSets: make([]schema.Workload, 0, len(ns.StatefulSets)),
+		}
+		for i := range ns.Deployments {
+			n.Deployments = append(n.Deployments, slimDeployment(&ns.Deployments[i]))
+		}
+		for i := range ns.StatefulSets {
+			n.StatefulSets = append(n.StatefulSets, slimStatefulSet(&ns.StatefulSets[i]))
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+func slimDeployment(d *Deployment) schema.Workload {
+	w := schema.NewWorkload(schema.WorkloadSource{
+		Kind:               "Deployment",
+		Meta:               d.Data.ObjectMeta,
+		Replicas:           d.Data.Spec.Replicas,
+		Selector:           d.Data.Spec.Selector,
+		Template:           d.Data.Spec.Template,
+		ReadyReplicas:      d.Data.Status.ReadyReplicas,
+		UpdatedReplicas:    d.Data.Status.UpdatedReplicas,
+		AvailableReplicas:  d.Data.Status.AvailableReplicas,
+		ObservedGeneration: d.Data.Status.ObservedGeneration,
+	})
+	w.Pods = slimPods(d.Pods)
+	return w
+}
+
+func slimStatefulSet(s *StatefulSet) schema.Workload {
+	w := schema.NewWorkload(schema.WorkloadSource{
+		Kind:            "StatefulSet",
+		Meta:            s.Data.ObjectMeta,
+		Replicas:        s.Data.Spec.Replicas,
+		Selector:        s.Data.Spec.Selector,
+		Template:        s.Data.Spec.Template,
+		ReadyReplicas:   s.Data.Status.ReadyReplicas,
+		UpdatedReplicas: s.Data.Status.UpdatedReplicas,
+	})
+	if s.Data.Status.ObservedGeneration != nil {
+		w.ObservedGeneration = *s.Data.Status.ObservedGeneration
+	}
+	w.Pods = slimPods(s.Pods)
+	return w
+}
+
+func slimPods(pods []Pod) []schema.Pod {
+	list := make([]schema.Pod, 0, len(pods))
+	for i := range pods {
+		list = append(list, schema.NewPod(&pods[i].Data))
+	}
+	return list
+}
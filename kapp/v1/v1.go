@@ -1,15 +1,28 @@
 package v1
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"io"
 	"k8s.io/api/apps/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	extensionsbeta1 "k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"kappagent/kapp/collect"
+	"kappagent/kapp/event"
+	"kappagent/kapp/option"
+	"kappagent/kapp/pipeline"
+	"kappagent/kapp/rbac"
+	"kappagent/kapp/schema"
+	"kappagent/util/backoff"
+	"kappagent/util/health"
+	"kappagent/util/metrics"
+	"kappagent/util/sink"
 	"kappagent/util/tool"
 	"regexp"
 	"sync"
@@ -20,8 +33,9 @@ type Agent struct {
 	clientSet                    *kubernetes.Clientset
 	clusterName                  string
 	cloud                        string
-	siteUrl                      string
+	sink                         sink.Sink
 	regExp                       *regexp.Regexp
+	opt                          option.Options
 	watchDeploymentChannel       chan WatchDepData
 	watchStatefulSetChannel      chan WatchStatefulData
 	watchNodeChannel             chan WatchNodeData
@@ -31,22 +45,39 @@ type Agent struct {
 	closeWatchDeploymentChannel  chan int
 	closeWatchStatefulSetChannel chan int
 	closeWatchNodeChannel        chan int
+	closeResyncChannel           chan int
 	closer                       sync.WaitGroup
+	health                       *health.Tracker
+	log                          *logrus.Entry
+	access                       *rbac.Access
+	pipe                         *pipeline.Pipeline
+}
+
+// agent 需要的权限
+var Rules = []rbac.Rule{
+	{Name: "Namespace", Group: "", Resource: "namespaces", Verbs: []string{"list"}},
+	{Name: "Node", Group: "", Resource: "nodes", Verbs: []string{"list", "watch"}},
+	{Name: "Pod", Group: "", Resource: "pods", Verbs: []string{"list"}, Namespaced: true},
+	{Name: "Deployment", Group: "extensions", Resource: "deployments", Verbs: []string{"list", "watch"}, Namespaced: true},
+	{Name: "StatefulSet", Group: "apps", Resource: "statefulsets", Verbs: []string{"list", "watch"}, Namespaced: true},
 }
 
 type Service interface {
-	StartRegCluster() bool
-	Run()
+	StartRegCluster(ctx context.Context) bool
+	Snapshot() (interface{}, error)
+	Run() error
 	Close()
+	Health() *health.Tracker
 }
 
-func NewV1Agent(clientSet *kubernetes.Clientset, clusterName string, cloud string, siteUrl string, regExp *regexp.Regexp) Service {
-	return &Agent{
+func NewV1Agent(clientSet *kubernetes.Clientset, clusterName string, cloud string, s sink.Sink, regExp *regexp.Regexp, opt option.Options) Service {
+	agent := &Agent{
 		clientSet:                    clientSet,
 		clusterName:                  clusterName,
 		cloud:                        cloud,
-		siteUrl:                      siteUrl,
+		sink:                         s,
 		regExp:                       regExp,
+		opt:                          opt,
 		watchDeploymentChannel:       make(chan WatchDepData, 100),
 		watchStatefulSetChannel:      make(chan WatchStatefulData, 100),
 		watchNodeChannel:             make(chan WatchNodeData, 100),
@@ -54,192 +85,479 @@ func NewV1Agent(clientSet *kubernetes.Clientset, clusterName string, cloud strin
 		closeWatchDeploymentChannel:  make(chan int, 1),
 		closeWatchStatefulSetChannel: make(chan int, 1),
 		closeWatchNodeChannel:        make(chan int, 1),
+		closeResyncChannel:           make(chan int, 1),
+		log:                          tool.Log.WithField(tool.FieldCluster, clusterName),
+	}
+	watches := []string{"Node"}
+	for _, ns := range agent.watchNamespaces() {
+		watches = append(watches, watchKey("Deployment", ns), watchKey("StatefulSet", ns))
+	}
+	agent.health = health.NewTracker(watches, opt.LivenessThreshold, agent.pending)
+	agent.pipe = pipeline.New(clusterName, cloud, s, opt, agent.health, agent.process)
+	return agent
+}
+
+// 等待发送的事件数
+func (v1 *Agent) pending() int {
+	return len(v1.watchDeploymentChannel) + len(v1.watchStatefulSetChannel) + len(v1.watchNodeChannel) + v1.pipe.Pending()
+}
+
+func (v1 *Agent) Health() *health.Tracker {
+	return v1.health
+}
+
+func (v1 *Agent) registerMetrics() {
+	queues := map[string]func() int{
+		"Deployment":  func() int { return len(v1.watchDeploymentChannel) },
+		"StatefulSet": func() int { return len(v1.watchStatefulSetChannel) },
+		"Node":        func() int { return len(v1.watchNodeChannel) },
+	}
+	for resource, f := range queues {
+		if err := metrics.RegisterQueueDepth(v1.clusterName, resource, f); err != nil {
+			v1.log.WithError(err).Warn("注册队列指标失败")
+		}
 	}
 }
 
-func (v1 *Agent) Run() {
-	v1.closer.Add(4)
+// 运行到关闭为止，协程panic时关闭所有watch并返回错误，由调用方重启
+func (v1 *Agent) Run() error {
+	// NewKapp 同时创建v1、v2 agent，只有实际运行的agent注册队列指标
+	v1.registerMetrics()
+	v1.health.Start()
+	v1.closer.Add(2)
 	go v1.startGetChannel()
-	go v1.startWatchDeployment()
-	go v1.startWatchStatefulSet()
+	v1.pipe.Start(&v1.closer)
 	go v1.startWatchNode()
-	v1.closer.Wait()
+	for _, ns := range v1.watchNamespaces() {
+		v1.closer.Add(2)
+		go v1.startWatchDeployment(ns)
+		go v1.startWatchStatefulSet(ns)
+	}
+	if v1.opt.ResyncInterval > 0 {
+		v1.closer.Add(1)
+		go v1.startResync()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		v1.closer.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case err := <-v1.pipe.Failed():
+		// 等所有协程退出后再返回，重启时不会遗留watch和发送协程
+		v1.Close()
+		<-done
+		return err
+	}
+}
+
+// 需要watch的namespace，没有配置namespace时watch整个集群
+func (v1 *Agent) watchNamespaces() []string {
+	if len(v1.opt.Namespaces) > 0 {
+		return v1.opt.Namespaces
+	}
+	return []string{metav1.NamespaceAll}
+}
+
+// 健康检查中watch的名称
+func watchKey(resource, namespace string) string {
+	if namespace == metav1.NamespaceAll {
+		return resource
+	}
+	return resource + "/" + namespace
+}
+
+// namespace是否需要采集。配置了namespace时只会采集配置的namespace，不再做过滤
+func (v1 *Agent) included(nname string) bool {
+	if len(v1.opt.Namespaces) > 0 {
+		return true
+	}
+	return nname != "default" && nname != "kube-system" &&
+		nname != "kube-public" && nname != "local" && nname != "tools" &&
+		!v1.regExp.MatchString(nname)
 }
 
 func (v1 *Agent) Close() {
-	v1.closeWatchChannel <- 1
+	select {
+	case v1.closeWatchChannel <- 1:
+	default:
+	}
+}
+
+// 初始化注册集群，ctx 取消后不再发送，正在发送的请求也会中断
+func (v1 *Agent) StartRegCluster(ctx context.Context) bool {
+	v1.checkAccess()
+	project, err := v1.getProject()
+	if err != nil {
+		return false
+	}
+	v1.inventoryProject(project)
+	return v1.pipe.Register(ctx, v1.pipelineProject(project))
+}
+
+// 生成与注册时相同的全量数据，不发送
+func (v1 *Agent) Snapshot() (interface{}, error) {
+	v1.checkAccess()
+	project, err := v1.getProject()
+	if err != nil {
+		return nil, err
+	}
+	return v1.payload(project), nil
+}
+
+// 周期全量同步
+func (v1 *Agent) startResync() {
+	v1.pipe.RunResync(v1.closeResyncChannel, v1.resyncProject)
+	v1.closer.Done()
 }
 
-// 初始化注册集群
-func (v1 *Agent) StartRegCluster() bool {
+// 周期全量同步时采集的数据
+func (v1 *Agent) resyncProject() (*pipeline.Project, error) {
+	project, err := v1.getProject()
+	if err != nil {
+		return nil, err
+	}
+	project.Resync = true
+	v1.inventoryProject(project)
+	return v1.pipelineProject(project), nil
+}
+
+// 获取集群全量数据
+// 部分资源获取失败时仍然返回数据，并在Failures里记录失败的资源
+func (v1 *Agent) getProject() (*Project, error) {
+	namespaces, failures, err := v1.getResourceWithNamespace()
+	if err != nil {
+		return nil, err
+	}
+	nodes, cerr := v1.getNode()
+	if cerr != nil {
+		failures = append(failures, cerr.Failure())
+	}
+
 	project := &Project{
 		ClusterName: v1.clusterName,
 		Timestamp:   time.Now().Unix(),
-		Namespaces:  v1.getResourceWithNamespace(),
-		Nodes:       v1.getNode(),
+		Namespaces:  namespaces,
+		Nodes:       nodes,
 		Cloud:       v1.cloud,
+		Partial:     len(failures) > 0,
+		Failures:    failures,
+	}
+	if len(v1.opt.Namespaces) > 0 {
+		project.PartialScope = true
+		project.ScopeNamespaces = v1.opt.Namespaces
 	}
+	v1.mutex.RLock()
+	project.MissingPermissions = v1.access.Denied()
+	v1.mutex.RUnlock()
+	if len(project.MissingPermissions) > 0 {
+		project.Partial = true
+	}
+	project.Hash = projectHash(project)
+	return project, nil
+}
 
-	jsonBytes, err := json.Marshal(project)
+// 检查agent的权限，缺少权限的资源跳过不采集
+func (v1 *Agent) checkAccess() {
+	access, err := rbac.SelfCheck(v1.clientSet, Rules, v1.opt.Namespaces)
 	if err != nil {
-		tool.Log.Error(err)
+		v1.log.WithError(err).Warn("权限检查失败，按拥有全部权限处理")
+		return
+	}
+	denied := access.DeniedStrings()
+	if len(denied) > 0 {
+		v1.log.WithField("missing", denied).Warn("缺少权限，相关资源将不会采集")
+	}
+
+	v1.mutex.Lock()
+	v1.access = access
+	v1.mutex.Unlock()
+	v1.health.SetMissingPermissions(denied)
+}
+
+// 是否拥有资源在namespace里的全部动作权限
+func (v1 *Agent) allowed(name, namespace string, verbs ...string) bool {
+	v1.mutex.RLock()
+	defer v1.mutex.RUnlock()
+	for _, verb := range verbs {
+		if !v1.access.Allowed(name, namespace, verb) {
+			return false
+		}
 	}
+	return true
+}
 
-	success := tool.RegCluster(string(jsonBytes), v1.siteUrl)
-	return success
+// 计算全量数据的hash，只包含精简数据结构中的字段并忽略resourceVersion，
+// 心跳和状态更新时间这类每次都会变化的字段不影响hash
+func projectHash(project *Project) string {
+	nodes := make([]schema.Node, 0, len(project.Nodes))
+	for i := range project.Nodes {
+		nodes = append(nodes, schema.NewNode(&project.Nodes[i]))
+	}
+	hash, err := schema.ProjectHash(project.ClusterName, project.Cloud, slimNamespaces(project.Namespaces), nodes)
+	if err != nil {
+		tool.Log.Error(err)
+		return ""
+	}
+	return hash
 }
 
 // 接收channel发送数据
 func (v1 *Agent) startGetChannel() {
-loop:
+	defer v1.closer.Done()
+	defer func() {
+		// 不再接收watch数据，直接关闭所有watch
+		if r := recover(); r != nil {
+			v1.pipe.Fail(r)
+			v1.shutdown()
+		}
+	}()
 	for {
 		select {
 		case e := <-v1.watchDeploymentChannel:
-			tool.Log.Infof("%s Deployment,Name: %s,NameSpace: %s", e.Type, e.Deployment.Name, e.Namespace)
-			watchProject := &WatchProject{
-				ClusterName:  v1.clusterName,
-				Type:         e.Type,
-				Timestamp:    time.Now().Unix(),
-				ResourceType: "Deployment",
-				Namespaces: []Namespace{
+			v1.pipe.Dispatch(pipeline.Event{Resource: "Deployment", Type: e.Type, Object: e.Deployment, Data: e})
+		case e := <-v1.watchStatefulSetChannel:
+			v1.pipe.Dispatch(pipeline.Event{Resource: "StatefulSet", Type: e.Type, Object: e.StatefulSet, Data: e})
+		case e := <-v1.watchNodeChannel:
+			v1.pipe.Dispatch(pipeline.Event{Resource: "Node", Type: e.Type, Object: e.Node, Data: e})
+		case <-v1.closeWatchChannel:
+			v1.shutdown()
+			v1.log.Info("正在关闭数据发送通道")
+			return
+		}
+	}
+}
+
+// 关闭所有watch、全量同步和发送流程
+func (v1 *Agent) shutdown() {
+	v1.mutex.Lock()
+	if !v1.closed {
+		v1.closed = true
+		close(v1.closeWatchDeploymentChannel)
+		close(v1.watchDeploymentChannel)
+		close(v1.closeWatchStatefulSetChannel)
+		close(v1.watchStatefulSetChannel)
+		v1.closeWatchNodeChannel <- 1
+		close(v1.watchNodeChannel)
+		v1.closeResyncChannel <- 1
+	}
+	v1.mutex.Unlock()
+	v1.pipe.Stop()
+}
+
+// 处理一个事件，合并后的事件类型以 e.Type 为准
+func (v1 *Agent) process(e pipeline.Event, seq *event.Sequencer) {
+	switch data := e.Data.(type) {
+	case WatchDepData:
+		data.Type = e.Type
+		v1.handleDeployment(data, seq)
+	case WatchStatefulData:
+		data.Type = e.Type
+		v1.handleStatefulSet(data, seq)
+	case WatchNodeData:
+		data.Type = e.Type
+		v1.handleNode(data, seq)
+	}
+}
+
+func (v1 *Agent) handleDeployment(e WatchDepData, seq *event.Sequencer) {
+	v1.log.WithFields(logrus.Fields{
+		tool.FieldResource:  "Deployment",
+		tool.FieldNamespace: e.Namespace,
+		tool.FieldName:      e.Deployment.Name,
+		tool.FieldEvent:     e.Type,
+	}).Info("收到watch事件")
+	v1.redactWorkload(&e.Deployment.ObjectMeta, &e.Deployment.Spec.Template)
+	pods, cerr := v1.getPod(e.Namespace, e.Deployment.Spec.Selector.MatchLabels)
+	watchProject := &WatchProject{
+		ClusterName:  v1.clusterName,
+		Type:         e.Type,
+		Timestamp:    time.Now().Unix(),
+		ResourceType: "Deployment",
+		Namespaces: []Namespace{
+			{
+				Name: e.Namespace,
+				Deployments: []Deployment{
 					{
-						Name: e.Namespace,
-						Deployments: []Deployment{
-							{
-								Data: *e.Deployment,
-								Pods: v1.getPod(e.Namespace, e.Deployment.Spec.Selector.MatchLabels),
-							},
-						},
+						Data: *e.Deployment,
+						Pods: pods,
 					},
 				},
-			}
+			},
+		},
+	}
 
-			jsonBytes, err := json.Marshal(watchProject)
-			if err != nil {
-				tool.Log.Error(err)
-			}
+	if cerr != nil {
+		watchProject.Failures = []collect.Failure{cerr.Failure()}
+	}
+	v1.inventoryWorkload(watchProject, cerr == nil)
+	obj, full := v1.watchPayload(watchProject)
+	v1.pipe.SendObject(watchProject.ResourceType, e.Deployment, e.Type, obj, full, cerr == nil, seq)
+}
 
-			tool.HttpPostForm(string(jsonBytes), v1.siteUrl, e.Type)
-		case e := <-v1.watchStatefulSetChannel:
-			tool.Log.Infof("%s StatefulSet,Name: %s,NameSpace: %s", e.Type, e.StatefulSet.Name, e.Namespace)
-			watchProject := &WatchProject{
-				ClusterName:  v1.clusterName,
-				Type:         e.Type,
-				Timestamp:    time.Now().Unix(),
-				ResourceType: "StatefulSet",
-				Namespaces: []Namespace{
+func (v1 *Agent) handleStatefulSet(e WatchStatefulData, seq *event.Sequencer) {
+	v1.log.WithFields(logrus.Fields{
+		tool.FieldResource:  "StatefulSet",
+		tool.FieldNamespace: e.Namespace,
+		tool.FieldName:      e.StatefulSet.Name,
+		tool.FieldEvent:     e.Type,
+	}).Info("收到watch事件")
+	v1.redactWorkload(&e.StatefulSet.ObjectMeta, &e.StatefulSet.Spec.Template)
+	pods, cerr := v1.getPod(e.Namespace, e.StatefulSet.Spec.Selector.MatchLabels)
+	watchProject := &WatchProject{
+		ClusterName:  v1.clusterName,
+		Type:         e.Type,
+		Timestamp:    time.Now().Unix(),
+		ResourceType: "StatefulSet",
+		Namespaces: []Namespace{
+			{
+				Name: e.Namespace,
+				StatefulSets: []StatefulSet{
 					{
-						Name: e.Namespace,
-						StatefulSets: []StatefulSet{
-							{
-								Data: *e.StatefulSet,
-								Pods: v1.getPod(e.Namespace, e.StatefulSet.Spec.Selector.MatchLabels),
-							},
-						},
+						Data: *e.StatefulSet,
+						Pods: pods,
 					},
 				},
-			}
-
-			jsonBytes, err := json.Marshal(watchProject)
-			if err != nil {
-				tool.Log.Error(err)
-			}
-
-			tool.HttpPostForm(string(jsonBytes), v1.siteUrl, e.Type)
-		case e := <-v1.watchNodeChannel:
-			tool.Log.Infof("%s Node,Addresses: %s", e.Type, e.Node.Status.Addresses)
-			watchNode := &WatchNode{
-				ClusterName:  v1.clusterName,
-				Type:         e.Type,
-				Timestamp:    time.Now().Unix(),
-				ResourceType: "Node",
-				Node:         *e.Node,
-			}
-
-			jsonBytes, err := json.Marshal(watchNode)
-			if err != nil {
-				tool.Log.Error(err)
-			}
+			},
+		},
+	}
 
-			tool.HttpPostForm(string(jsonBytes), v1.siteUrl, e.Type)
-		case <-v1.closeWatchChannel:
-			v1.mutex.Lock()
-
-			if !v1.closed {
-				v1.closed = true
-				v1.closeWatchDeploymentChannel <- 1
-				close(v1.watchDeploymentChannel)
-				v1.closeWatchStatefulSetChannel <- 1
-				close(v1.watchStatefulSetChannel)
-				v1.closeWatchNodeChannel <- 1
-				close(v1.watchNodeChannel)
-			}
+	if cerr != nil {
+		watchProject.Failures = []collect.Failure{cerr.Failure()}
+	}
+	v1.inventoryWorkload(watchProject, cerr == nil)
+	obj, full := v1.watchPayload(watchProject)
+	v1.pipe.SendObject(watchProject.ResourceType, e.StatefulSet, e.Type, obj, full, cerr == nil, seq)
+}
 
-			v1.mutex.Unlock()
-			tool.Log.Info("正在关闭数据发送通道")
-			break loop
-		}
+func (v1 *Agent) handleNode(e WatchNodeData, seq *event.Sequencer) {
+	v1.log.WithFields(logrus.Fields{
+		tool.FieldResource: "Node",
+		tool.FieldName:     e.Node.Name,
+		tool.FieldEvent:    e.Type,
+		"addresses":        e.Node.Status.Addresses,
+	}).Info("收到watch事件")
+	v1.opt.Redact.Node(e.Node)
+	watchNode := &WatchNode{
+		ClusterName:  v1.clusterName,
+		Type:         e.Type,
+		Timestamp:    time.Now().Unix(),
+		ResourceType: "Node",
+		Node:         *e.Node,
 	}
-	v1.closer.Done()
+
+	v1.inventoryNode(watchNode)
+	obj, full := v1.watchNodePayload(watchNode)
+	v1.pipe.SendObject(watchNode.ResourceType, e.Node, e.Type, obj, full, true, seq)
 }
 
-// 监听资源变化
-func (v1 *Agent) startWatchDeployment() {
+// 循环执行watch，watch出错时退避重试，关闭时退出
+func (v1 *Agent) keepWatching(resource, namespace string, handler func() error) {
+	log := v1.log.WithFields(logrus.Fields{
+		tool.FieldResource:  resource,
+		tool.FieldNamespace: namespace,
+	})
+	if !v1.allowed(resource, namespace, "list", "watch") {
+		log.Warn("缺少权限，跳过watch")
+		v1.health.WatchSkipped(watchKey(resource, namespace))
+		return
+	}
+	b := backoff.NewBackoff(time.Second, time.Minute)
+	failures := 0
 	for {
-		if err := v1.watchDepHandler(); err == nil {
-			tool.Log.Info("watch deployment is stop! restart now...")
-		} else {
-			tool.Log.Info("正在关闭DeploymentWatch")
+		err := handler()
+		if err == io.ErrClosedPipe || v1.isClosed() {
+			log.Info("正在关闭watch")
 			break
 		}
+		if err != nil {
+			failures++
+			wait := b.Duration(failures)
+			log.WithError(err).WithField("wait", wait.String()).Warn("watch失败，稍后重试")
+			time.Sleep(wait)
+			continue
+		}
+		failures = 0
+		log.Info("watch已断开，正在重启")
+		metrics.WatchRestarts.WithLabelValues(v1.clusterName, resource).Inc()
 	}
+}
+
+func (v1 *Agent) isClosed() bool {
+	v1.mutex.RLock()
+	defer v1.mutex.RUnlock()
+	return v1.closed
+}
+
+// 记录采集失败的日志和指标
+func (v1 *Agent) collectError(cerr *collect.Error) *collect.Error {
+	metrics.CollectErrors.WithLabelValues(v1.clusterName, cerr.Resource, string(cerr.Reason)).Inc()
+	v1.log.WithError(cerr.Err).WithFields(logrus.Fields{
+		tool.FieldResource:  cerr.Resource,
+		tool.FieldNamespace: cerr.Namespace,
+		"reason":            cerr.Reason,
+	}).Warn("获取数据失败")
+	return cerr
+}
+
+// 监听资源变化
+func (v1 *Agent) startWatchDeployment(namespace string) {
+	v1.keepWatching("Deployment", namespace, func() error {
+		return v1.watchDepHandler(namespace)
+	})
 	v1.closer.Done()
 }
 
-func (v1 *Agent) startWatchStatefulSet() {
-	for {
-		if err := v1.watchStatefulHandler(); err == nil {
-			tool.Log.Info("watch statefulset is stop! restart now...")
-		} else {
-			tool.Log.Info("正在关闭StatefulSetWatch")
-			break
-		}
-	}
+func (v1 *Agent) startWatchStatefulSet(namespace string) {
+	v1.keepWatching("StatefulSet", namespace, func() error {
+		return v1.watchStatefulHandler(namespace)
+	})
 	v1.closer.Done()
 }
 
 func (v1 *Agent) startWatchNode() {
-	for {
-		if err := v1.watchNodeHandler(); err == nil {
-			tool.Log.Info("watch node is stop! restart now...")
-		} else {
-			tool.Log.Info("正在关闭NodeWatch")
-			break
-		}
-	}
+	v1.keepWatching("Node", metav1.NamespaceAll, v1.watchNodeHandler)
 	v1.closer.Done()
 }
 
 // watch handler
-func (v1 *Agent) watchDepHandler() error {
+func (v1 *Agent) watchDepHandler(namespace string) (err error) {
 	defer func() {
-		err := recover()
-		if err != nil {
-			tool.Log.Error(err)
+		if r := recover(); r != nil {
+			v1.log.Error(r)
+			err = fmt.Errorf("%v", r)
 		}
 	}()
-	tool.Log.Info("正在监听deployment...")
-	deploymentsClient := v1.clientSet.ExtensionsV1beta1().Deployments(metav1.NamespaceAll)
-
-	list, _ := deploymentsClient.List(metav1.ListOptions{})
+	v1.log.WithFields(logrus.Fields{
+		tool.FieldResource:  "Deployment",
+		tool.FieldNamespace: namespace,
+	}).Info("正在监听...")
+	deploymentsClient := v1.clientSet.ExtensionsV1beta1().Deployments(namespace)
+
+	var list *extensionsbeta1.DeploymentList
+	if cerr := collect.Retry(v1.opt.CollectRetries, "Deployment", namespace, func() (err error) {
+		list, err = deploymentsClient.List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return v1.collectError(cerr)
+	}
 	items := list.Items
 
 	timeoutSeconds := int64((15 * time.Minute).Seconds())
 	options := metav1.ListOptions{
 		TimeoutSeconds: &timeoutSeconds,
 	}
-	w, _ := deploymentsClient.Watch(options)
+	w, err := deploymentsClient.Watch(options)
+	if err != nil {
+		return v1.collectError(collect.NewError("Deployment", namespace, err))
+	}
 	defer w.Stop()
+	key := watchKey("Deployment", namespace)
+	v1.health.WatchEstablished(key)
+	defer v1.health.WatchStopped(key)
 
 	// 为了第一次不发送数据，启动watch第一次会输出所有的数据
 	count := 0
@@ -251,21 +569,32 @@ loop:
 		case e, ok := <-w.ResultChan():
 			if !ok {
 				break loop
-			} else if e.Type == watch.Added || e.Type == watch.Deleted || e.Type == watch.Modified {
+			}
+			v1.health.WatchProgress(key)
+			if e.Type == watch.Error {
+				return v1.collectError(collect.NewError("Deployment", namespace, apierrors.FromObject(e.Object)))
+			}
+			if e.Type == watch.Added || e.Type == watch.Deleted || e.Type == watch.Modified {
 				if count != len(items) {
 					count += 1
 				} else {
+					metrics.EventsSeen.WithLabelValues(v1.clusterName, "Deployment", string(e.Type)).Inc()
 					// go的断言获取运行时的struct
-					nname := e.Object.(*extensionsbeta1.Deployment).Namespace
-					if nname != "default" && nname != "kube-system" &&
-						nname != "kube-public" && nname != "local" && nname != "tools" &&
-						!v1.regExp.MatchString(nname) {
+					deployment, ok := e.Object.(*extensionsbeta1.Deployment)
+					if !ok {
+						v1.collectError(collect.NewConversionError("Deployment", "", e.Object))
+						continue
+					}
+					nname := deployment.Namespace
+					if v1.included(nname) {
 						data := WatchDepData{
-							Deployment: e.Object.(*extensionsbeta1.Deployment),
-							Namespace:  e.Object.(*extensionsbeta1.Deployment).Namespace,
+							Deployment: deployment,
+							Namespace:  nname,
 							Type:       e.Type,
 						}
 						v1.watchDeploymentChannel <- data
+					} else {
+						metrics.EventsDropped.WithLabelValues(v1.clusterName, "Deployment", string(e.Type), metrics.DropFiltered).Inc()
 					}
 				}
 			}
@@ -280,25 +609,40 @@ loop:
 	return nil
 }
 
-func (v1 *Agent) watchStatefulHandler() error {
+func (v1 *Agent) watchStatefulHandler(namespace string) (err error) {
 	defer func() {
-		err := recover()
-		if err != nil {
-			tool.Log.Error(err)
+		if r := recover(); r != nil {
+			v1.log.Error(r)
+			err = fmt.Errorf("%v", r)
 		}
 	}()
-	tool.Log.Info("正在监听statefulset...")
-	statefulSetClient := v1.clientSet.AppsV1beta1().StatefulSets(metav1.NamespaceAll)
-
-	list, _ := statefulSetClient.List(metav1.ListOptions{})
+	v1.log.WithFields(logrus.Fields{
+		tool.FieldResource:  "StatefulSet",
+		tool.FieldNamespace: namespace,
+	}).Info("正在监听...")
+	statefulSetClient := v1.clientSet.AppsV1beta1().StatefulSets(namespace)
+
+	var list *v1beta1.StatefulSetList
+	if cerr := collect.Retry(v1.opt.CollectRetries, "StatefulSet", namespace, func() (err error) {
+		list, err = statefulSetClient.List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return v1.collectError(cerr)
+	}
 	items := list.Items
 
 	timeoutSeconds := int64((15 * time.Minute).Seconds())
 	options := metav1.ListOptions{
 		TimeoutSeconds: &timeoutSeconds,
 	}
-	w, _ := statefulSetClient.Watch(options)
+	w, err := statefulSetClient.Watch(options)
+	if err != nil {
+		return v1.collectError(collect.NewError("StatefulSet", namespace, err))
+	}
 	defer w.Stop()
+	key := watchKey("StatefulSet", namespace)
+	v1.health.WatchEstablished(key)
+	defer v1.health.WatchStopped(key)
 
 	// 为了第一次不发送数据，启动watch第一次会输出所有的数据
 	count := 0
@@ -310,21 +654,32 @@ loop:
 		case e, ok := <-w.ResultChan():
 			if !ok {
 				break loop
-			} else if e.Type == watch.Added || e.Type == watch.Deleted || e.Type == watch.Modified {
+			}
+			v1.health.WatchProgress(key)
+			if e.Type == watch.Error {
+				return v1.collectError(collect.NewError("StatefulSet", namespace, apierrors.FromObject(e.Object)))
+			}
+			if e.Type == watch.Added || e.Type == watch.Deleted || e.Type == watch.Modified {
 				if count != len(items) {
 					count += 1
 				} else {
+					metrics.EventsSeen.WithLabelValues(v1.clusterName, "StatefulSet", string(e.Type)).Inc()
 					// go的断言获取运行时的struct
-					nname := e.Object.(*v1beta1.StatefulSet).Namespace
-					if nname != "default" && nname != "kube-system" &&
-						nname != "kube-public" && nname != "local" && nname != "tools" &&
-						!v1.regExp.MatchString(nname) {
+					statefulSet, ok := e.Object.(*v1beta1.StatefulSet)
+					if !ok {
+						v1.collectError(collect.NewConversionError("StatefulSet", "", e.Object))
+						continue
+					}
+					nname := statefulSet.Namespace
+					if v1.included(nname) {
 						data := WatchStatefulData{
-							StatefulSet: e.Object.(*v1beta1.StatefulSet),
-							Namespace:   e.Object.(*v1beta1.StatefulSet).Namespace,
+							StatefulSet: statefulSet,
+							Namespace:   nname,
 							Type:        e.Type,
 						}
 						v1.watchStatefulSetChannel <- data
+					} else {
+						metrics.EventsDropped.WithLabelValues(v1.clusterName, "StatefulSet", string(e.Type), metrics.DropFiltered).Inc()
 					}
 				}
 			}
@@ -339,25 +694,36 @@ loop:
 	return nil
 }
 
-func (v1 *Agent) watchNodeHandler() error {
+func (v1 *Agent) watchNodeHandler() (err error) {
 	defer func() {
-		err := recover()
-		if err != nil {
-			tool.Log.Error(err)
+		if r := recover(); r != nil {
+			v1.log.Error(r)
+			err = fmt.Errorf("%v", r)
 		}
 	}()
-	tool.Log.Info("正在监听node...")
+	v1.log.WithField(tool.FieldResource, "Node").Info("正在监听...")
 	nodesClient := v1.clientSet.CoreV1().Nodes()
 
-	list, _ := nodesClient.List(metav1.ListOptions{})
+	var list *corev1.NodeList
+	if cerr := collect.Retry(v1.opt.CollectRetries, "Node", metav1.NamespaceAll, func() (err error) {
+		list, err = nodesClient.List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return v1.collectError(cerr)
+	}
 	items := list.Items
 
 	timeoutSeconds := int64((15 * time.Minute).Seconds())
 	options := metav1.ListOptions{
 		TimeoutSeconds: &timeoutSeconds,
 	}
-	w, _ := nodesClient.Watch(options)
+	w, err := nodesClient.Watch(options)
+	if err != nil {
+		return v1.collectError(collect.NewError("Node", metav1.NamespaceAll, err))
+	}
 	defer w.Stop()
+	v1.health.WatchEstablished("Node")
+	defer v1.health.WatchStopped("Node")
 
 	// 为了第一次不发送数据，启动watch第一次会输出所有的数据
 	count := 0
@@ -369,12 +735,23 @@ loop:
 		case e, ok := <-w.ResultChan():
 			if !ok {
 				break loop
-			} else if e.Type == watch.Added || e.Type == watch.Deleted {
+			}
+			v1.health.WatchProgress("Node")
+			if e.Type == watch.Error {
+				return v1.collectError(collect.NewError("Node", metav1.NamespaceAll, apierrors.FromObject(e.Object)))
+			}
+			if e.Type == watch.Added || e.Type == watch.Deleted {
 				if count != len(items) {
 					count += 1
 				} else {
+					metrics.EventsSeen.WithLabelValues(v1.clusterName, "Node", string(e.Type)).Inc()
+					node, ok := e.Object.(*corev1.Node)
+					if !ok {
+						v1.collectError(collect.NewConversionError("Node", "", e.Object))
+						continue
+					}
 					data := WatchNodeData{
-						Node: e.Object.(*corev1.Node),
+						Node: node,
 						Type: e.Type,
 					}
 					v1.watchNodeChannel <- data
@@ -391,87 +768,173 @@ loop:
 	return nil
 }
 
+// 获取需要采集的namespace，配置了namespace时不再获取namespace列表
+func (v1 *Agent) getNamespaceNames() ([]string, error) {
+	if len(v1.opt.Namespaces) > 0 {
+		return v1.opt.Namespaces, nil
+	}
+	if !v1.allowed("Namespace", metav1.NamespaceAll, "list") {
+		v1.log.Warn("缺少namespace权限，跳过项目数据")
+		return nil, nil
+	}
+
+	var namespaceItems *corev1.NamespaceList
+	if cerr := collect.Retry(v1.opt.CollectRetries, "Namespace", "", func() (err error) {
+		namespaceItems, err = v1.clientSet.CoreV1().Namespaces().List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return nil, v1.collectError(cerr)
+	}
+
+	var names []string
+	for i := range namespaceItems.Items {
+		names = append(names, namespaceItems.Items[i].Name)
+	}
+	return names, nil
+}
+
 // 获取Resource
-func (v1 *Agent) getResourceWithNamespace() []Namespace {
-	tool.Log.Info("正在获取项目数据...")
+// namespace列表获取失败时返回error，其他资源获取失败记录在failures里
+func (v1 *Agent) getResourceWithNamespace() ([]Namespace, []collect.Failure, error) {
+	v1.log.Info("正在获取项目数据...")
 	var ns []Namespace
+	var failures []collect.Failure
 
-	namespaceItems, _ := v1.clientSet.CoreV1().Namespaces().List(metav1.ListOptions{})
-	nitems := namespaceItems.Items
+	nitems, err := v1.getNamespaceNames()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for i := range nitems {
+	for _, nname := range nitems {
 		// 收集deployment
-		nname := nitems[i].Name
-		if nname == "default" || nname == "kube-system" || nname == "kube-public" ||
-			nname == "local" || nname == "tools" || v1.regExp.MatchString(nname) {
+		if !v1.included(nname) {
 			continue
 		}
 		var ds []Deployment
 		var ss []StatefulSet
 
-		deploymentsClient, _ := v1.clientSet.ExtensionsV1beta1().Deployments(nname).List(metav1.ListOptions{})
+		deploymentsClient := &extensionsbeta1.DeploymentList{}
+		if v1.allowed("Deployment", nname, "list") {
+			if cerr := collect.Retry(v1.opt.CollectRetries, "Deployment", nname, func() (err error) {
+				deploymentsClient, err = v1.clientSet.ExtensionsV1beta1().Deployments(nname).List(metav1.ListOptions{})
+				return err
+			}); cerr != nil {
+				failures = append(failures, v1.collectError(cerr).Failure())
+				deploymentsClient = &extensionsbeta1.DeploymentList{}
+			}
+		}
 		ditems := deploymentsClient.Items
 
 		if len(ditems) == 0 {
-			tool.Log.Infof("namespace: %s has no deployment", nname)
+			v1.log.WithFields(logrus.Fields{
+				tool.FieldResource:  "Deployment",
+				tool.FieldNamespace: nname,
+			}).Debug("namespace下没有数据")
 		} else {
 			for q := range ditems {
 				o := ditems[q]
+				v1.redactWorkload(&o.ObjectMeta, &o.Spec.Template)
 
-				ps := v1.getPod(nname, o.Spec.Selector.MatchLabels)
+				ps, cerr := v1.getPod(nname, o.Spec.Selector.MatchLabels)
+				if cerr != nil {
+					failures = append(failures, cerr.Failure())
+				}
 				ds = append(ds, Deployment{Data: o, Pods: ps})
 			}
 		}
 
 		// 收集statefulset
-		statefulsetsClient, _ := v1.clientSet.AppsV1beta1().StatefulSets(nname).List(metav1.ListOptions{})
+		statefulsetsClient := &v1beta1.StatefulSetList{}
+		if v1.allowed("StatefulSet", nname, "list") {
+			if cerr := collect.Retry(v1.opt.CollectRetries, "StatefulSet", nname, func() (err error) {
+				statefulsetsClient, err = v1.clientSet.AppsV1beta1().StatefulSets(nname).List(metav1.ListOptions{})
+				return err
+			}); cerr != nil {
+				failures = append(failures, v1.collectError(cerr).Failure())
+				statefulsetsClient = &v1beta1.StatefulSetList{}
+			}
+		}
 		sitems := statefulsetsClient.Items
 		if len(sitems) == 0 {
-			tool.Log.Infof("namespace: %s has no statefulsets", nname)
+			v1.log.WithFields(logrus.Fields{
+				tool.FieldResource:  "StatefulSet",
+				tool.FieldNamespace: nname,
+			}).Debug("namespace下没有数据")
 		} else {
 			for q := range sitems {
 				o := sitems[q]
+				v1.redactWorkload(&o.ObjectMeta, &o.Spec.Template)
 
-				ps := v1.getPod(nname, o.Spec.Selector.MatchLabels)
+				ps, cerr := v1.getPod(nname, o.Spec.Selector.MatchLabels)
+				if cerr != nil {
+					failures = append(failures, cerr.Failure())
+				}
 				ss = append(ss, StatefulSet{Data: o, Pods: ps})
 			}
 		}
 
 		ns = append(ns, Namespace{Name: nname, Deployments: ds, StatefulSets: ss})
 	}
-	tool.Log.Info("获取项目数据完成...")
-	return ns
+	v1.log.WithField("failures", len(failures)).Info("获取项目数据完成...")
+	return ns, failures, nil
 }
 
-func (v1 *Agent) getPod(namespace string, labelSelector map[string]string) []Pod {
-	pods, _ := v1.clientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{
-		LabelSelector: labels.Set(labelSelector).String(),
-	})
+// 发送前对Deployment、StatefulSet脱敏，需要在计算hash和diff之前
+func (v1 *Agent) redactWorkload(meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec) {
+	v1.opt.Redact.Meta(meta)
+	v1.opt.Redact.PodTemplate(template)
+}
+
+func (v1 *Agent) getPod(namespace string, labelSelector map[string]string) ([]Pod, *collect.Error) {
+	if !v1.allowed("Pod", namespace, "list") {
+		return nil, nil
+	}
+	var pods *corev1.PodList
+	if cerr := collect.Retry(v1.opt.CollectRetries, "Pod", namespace, func() (err error) {
+		pods, err = v1.clientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{
+			LabelSelector: labels.Set(labelSelector).String(),
+		})
+		return err
+	}); cerr != nil {
+		return nil, v1.collectError(cerr)
+	}
 	items := pods.Items
 	var ps []Pod
 
 	for i := range items {
 		o := items[i]
+		v1.opt.Redact.Pod(&o)
 		var cs []Container
 		for q := range o.Spec.Containers {
 			cs = append(cs, Container{Data: o.Spec.Containers[q]})
 		}
 		ps = append(ps, Pod{Data: o, Containers: cs})
 	}
-	return ps
+	return ps, nil
 }
 
-func (v1 *Agent) getNode() []corev1.Node {
-	tool.Log.Info("正在获取Node数据...")
+func (v1 *Agent) getNode() ([]corev1.Node, *collect.Error) {
+	v1.log.Info("正在获取Node数据...")
 	var nodes []corev1.Node
+	if !v1.allowed("Node", metav1.NamespaceAll, "list") {
+		v1.log.Warn("缺少node权限，跳过Node数据")
+		return nodes, nil
+	}
 
 	nodesClient := v1.clientSet.CoreV1().Nodes()
-	list, _ := nodesClient.List(metav1.ListOptions{})
+	var list *corev1.NodeList
+	if cerr := collect.Retry(v1.opt.CollectRetries, "Node", "", func() (err error) {
+		list, err = nodesClient.List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return nil, v1.collectError(cerr)
+	}
 	items := list.Items
 
 	for _, v := range items {
+		v1.opt.Redact.Node(&v)
 		nodes = append(nodes, v)
 	}
-	tool.Log.Info("获取Node数据完成...")
-	return nodes
+	v1.log.Info("获取Node数据完成...")
+	return nodes, nil
 }
@@ -4,6 +4,9 @@ import (
 	"k8s.io/api/apps/v1beta2"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/watch"
+	"kappagent/kapp/collect"
+	"kappagent/kapp/event"
+	"kappagent/kapp/rbac"
 )
 
 type Project struct {
@@ -12,6 +15,18 @@ type Project struct {
 	Namespaces  []Namespace `json:"namespaces"`
 	Nodes       []v1.Node   `json:"nodes"`
 	Cloud       string      `json:"cloud"`
+	Resync      bool        `json:"resync"`
+	Hash        string      `json:"hash"`
+	// 部分资源获取失败
+	Partial  bool              `json:"partial"`
+	Failures []collect.Failure `json:"failures,omitempty"`
+	// 缺少的权限
+	MissingPermissions []rbac.Check `json:"missingPermissions,omitempty"`
+	// 只采集了部分namespace
+	PartialScope    bool     `json:"partialScope"`
+	ScopeNamespaces []string `json:"scopeNamespaces,omitempty"`
+	// 序号和幂等key
+	event.Meta
 }
 
 type Namespace struct {
@@ -45,6 +60,16 @@ type WatchProject struct {
 	ResourceType string          `json:"resourceType"`
 	Type         watch.EventType `json:"type"`
 	Namespaces   []Namespace     `json:"namespaces"`
+	// pod获取失败时记录原因
+	Failures []collect.Failure `json:"failures,omitempty"`
+	// diff模式下对象的hash，作为后续patch的基准
+	Hash string `json:"hash,omitempty"`
+	// 序号和幂等key
+	event.Meta
+}
+
+func (w *WatchProject) SetHash(hash string) {
+	w.Hash = hash
 }
 
 type WatchDepData struct {
@@ -65,6 +90,14 @@ type WatchNode struct {
 	ResourceType string          `json:"resourceType"`
 	Type         watch.EventType `json:"type"`
 	Node         v1.Node         `json:"node"`
+	// diff模式下对象的hash，作为后续patch的基准
+	Hash string `json:"hash,omitempty"`
+	// 序号和幂等key
+	event.Meta
+}
+
+func (w *WatchNode) SetHash(hash string) {
+	w.Hash = hash
 }
 
 type WatchNodeData struct {
@@ -1,14 +1,27 @@
 package v2
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"io"
 	"k8s.io/api/apps/v1beta2"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"kappagent/kapp/collect"
+	"kappagent/kapp/event"
+	"kappagent/kapp/option"
+	"kappagent/kapp/pipeline"
+	"kappagent/kapp/rbac"
+	"kappagent/kapp/schema"
+	"kappagent/util/backoff"
+	"kappagent/util/health"
+	"kappagent/util/metrics"
+	"kappagent/util/sink"
 	"kappagent/util/tool"
 	"regexp"
 	"sync"
@@ -19,8 +32,9 @@ type Agent struct {
 	clientSet                    *kubernetes.Clientset
 	clusterName                  string
 	cloud                        string
-	siteUrl                      string
+	sink                         sink.Sink
 	regExp                       *regexp.Regexp
+	opt                          option.Options
 	watchDeploymentChannel       chan WatchDepData
 	watchStatefulSetChannel      chan WatchStatefulData
 	watchNodeChannel             chan WatchNodeData
@@ -30,22 +44,39 @@ type Agent struct {
 	closeWatchDeploymentChannel  chan int
 	closeWatchStatefulSetChannel chan int
 	closeWatchNodeChannel        chan int
+	closeResyncChannel           chan int
 	closer                       sync.WaitGroup
+	health                       *health.Tracker
+	log                          *logrus.Entry
+	access                       *rbac.Access
+	pipe                         *pipeline.Pipeline
+}
+
+// agent 需要的权限
+var Rules = []rbac.Rule{
+	{Name: "Namespace", Group: "", Resource: "namespaces", Verbs: []string{"list"}},
+	{Name: "Node", Group: "", Resource: "nodes", Verbs: []string{"list", "watch"}},
+	{Name: "Pod", Group: "", Resource: "pods", Verbs: []string{"list"}, Namespaced: true},
+	{Name: "Deployment", Group: "apps", Resource: "deployments", Verbs: []string{"list", "watch"}, Namespaced: true},
+	{Name: "StatefulSet", Group: "apps", Resource: "statefulsets", Verbs: []string{"list", "watch"}, Namespaced: true},
 }
 
 type Service interface {
-	StartRegCluster() bool
-	Run()
+	StartRegCluster(ctx context.Context) bool
+	Snapshot() (interface{}, error)
+	Run() error
 	Close()
+	Health() *health.Tracker
 }
 
-func NewV2Agent(clientSet *kubernetes.Clientset, clusterName string, cloud string, siteUrl string, regExp *regexp.Regexp) Service {
-	return &Agent{
+func NewV2Agent(clientSet *kubernetes.Clientset, clusterName string, cloud string, s sink.Sink, regExp *regexp.Regexp, opt option.Options) Service {
+	agent := &Agent{
 		clientSet:                    clientSet,
 		clusterName:                  clusterName,
 		cloud:                        cloud,
-		siteUrl:                      siteUrl,
+		sink:                         s,
 		regExp:                       regExp,
+		opt:                          opt,
 		watchDeploymentChannel:       make(chan WatchDepData, 100),
 		watchStatefulSetChannel:      make(chan WatchStatefulData, 100),
 		watchNodeChannel:             make(chan WatchNodeData, 100),
@@ -53,185 +84,466 @@ func NewV2Agent(clientSet *kubernetes.Clientset, clusterName string, cloud strin
 		closeWatchDeploymentChannel:  make(chan int, 1),
 		closeWatchStatefulSetChannel: make(chan int, 1),
 		closeWatchNodeChannel:        make(chan int, 1),
+		closeResyncChannel:           make(chan int, 1),
+		log:                          tool.Log.WithField(tool.FieldCluster, clusterName),
+	}
+	watches := []string{"Node"}
+	for _, ns := range agent.watchNamespaces() {
+		watches = append(watches, watchKey("Deployment", ns), watchKey("StatefulSet", ns))
+	}
+	agent.health = health.NewTracker(watches, opt.LivenessThreshold, agent.pending)
+	agent.pipe = pipeline.New(clusterName, cloud, s, opt, agent.health, agent.process)
+	return agent
+}
+
+// 等待发送的事件数
+func (v2 *Agent) pending() int {
+	return len(v2.watchDeploymentChannel) + len(v2.watchStatefulSetChannel) + len(v2.watchNodeChannel) + v2.pipe.Pending()
+}
+
+func (v2 *Agent) Health() *health.Tracker {
+	return v2.health
+}
+
+func (v2 *Agent) registerMetrics() {
+	queues := map[string]func() int{
+		"Deployment":  func() int { return len(v2.watchDeploymentChannel) },
+		"StatefulSet": func() int { return len(v2.watchStatefulSetChannel) },
+		"Node":        func() int { return len(v2.watchNodeChannel) },
+	}
+	for resource, f := range queues {
+		if err := metrics.RegisterQueueDepth(v2.clusterName, resource, f); err != nil {
+			v2.log.WithError(err).Warn("注册队列指标失败")
+		}
 	}
 }
 
-func (v2 *Agent) Run() {
-	v2.closer.Add(4)
+// 运行到关闭为止，协程panic时关闭所有watch并返回错误，由调用方重启
+func (v2 *Agent) Run() error {
+	// NewKapp 同时创建v1、v2 agent，只有实际运行的agent注册队列指标
+	v2.registerMetrics()
+	v2.health.Start()
+	v2.closer.Add(2)
 	go v2.startGetChannel()
-	go v2.startWatchDeployment()
-	go v2.startWatchStatefulSet()
+	v2.pipe.Start(&v2.closer)
 	go v2.startWatchNode()
-	v2.closer.Wait()
+	for _, ns := range v2.watchNamespaces() {
+		v2.closer.Add(2)
+		go v2.startWatchDeployment(ns)
+		go v2.startWatchStatefulSet(ns)
+	}
+	if v2.opt.ResyncInterval > 0 {
+		v2.closer.Add(1)
+		go v2.startResync()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		v2.closer.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case err := <-v2.pipe.Failed():
+		// 等所有协程退出后再返回，重启时不会遗留watch和发送协程
+		v2.Close()
+		<-done
+		return err
+	}
+}
+
+// 需要watch的namespace，没有配置namespace时watch整个集群
+func (v2 *Agent) watchNamespaces() []string {
+	if len(v2.opt.Namespaces) > 0 {
+		return v2.opt.Namespaces
+	}
+	return []string{metav1.NamespaceAll}
+}
+
+// 健康检查中watch的名称
+func watchKey(resource, namespace string) string {
+	if namespace == metav1.NamespaceAll {
+		return resource
+	}
+	return resource + "/" + namespace
+}
+
+// namespace是否需要采集。配置了namespace时只会采集配置的namespace，不再做过滤
+func (v2 *Agent) included(nname string) bool {
+	if len(v2.opt.Namespaces) > 0 {
+		return true
+	}
+	return nname != "default" && nname != "kube-system" &&
+		nname != "kube-public" && nname != "local" && nname != "tools" &&
+		!v2.regExp.MatchString(nname)
 }
 
 func (v2 *Agent) Close() {
-	v2.closeWatchChannel <- 1
+	select {
+	case v2.closeWatchChannel <- 1:
+	default:
+	}
+}
+
+// 注册cluster，ctx 取消后不再发送，正在发送的请求也会中断
+func (v2 *Agent) StartRegCluster(ctx context.Context) bool {
+	v2.checkAccess()
+	project, err := v2.getProject()
+	if err != nil {
+		return false
+	}
+	v2.inventoryProject(project)
+	return v2.pipe.Register(ctx, v2.pipelineProject(project))
+}
+
+// 生成与注册时相同的全量数据，不发送
+func (v2 *Agent) Snapshot() (interface{}, error) {
+	v2.checkAccess()
+	project, err := v2.getProject()
+	if err != nil {
+		return nil, err
+	}
+	return v2.payload(project), nil
+}
+
+// 周期全量同步
+func (v2 *Agent) startResync() {
+	v2.pipe.RunResync(v2.closeResyncChannel, v2.resyncProject)
+	v2.closer.Done()
 }
 
-// 注册cluster
-func (v2 *Agent) StartRegCluster() bool {
+// 周期全量同步时采集的数据
+func (v2 *Agent) resyncProject() (*pipeline.Project, error) {
+	project, err := v2.getProject()
+	if err != nil {
+		return nil, err
+	}
+	project.Resync = true
+	v2.inventoryProject(project)
+	return v2.pipelineProject(project), nil
+}
+
+// 获取集群全量数据
+// 部分资源获取失败时仍然返回数据，并在Failures里记录失败的资源
+func (v2 *Agent) getProject() (*Project, error) {
+	namespaces, failures, err := v2.getResourceWithNamespace()
+	if err != nil {
+		return nil, err
+	}
+	nodes, cerr := v2.getNode()
+	if cerr != nil {
+		failures = append(failures, cerr.Failure())
+	}
+
 	project := &Project{
 		ClusterName: v2.clusterName,
 		Timestamp:   time.Now().Unix(),
-		Namespaces:  v2.getResourceWithNamespace(),
-		Nodes:       v2.getNode(),
+		Namespaces:  namespaces,
+		Nodes:       nodes,
 		Cloud:       v2.cloud,
+		Partial:     len(failures) > 0,
+		Failures:    failures,
+	}
+	if len(v2.opt.Namespaces) > 0 {
+		project.PartialScope = true
+		project.ScopeNamespaces = v2.opt.Namespaces
 	}
+	v2.mutex.RLock()
+	project.MissingPermissions = v2.access.Denied()
+	v2.mutex.RUnlock()
+	if len(project.MissingPermissions) > 0 {
+		project.Partial = true
+	}
+	project.Hash = projectHash(project)
+	return project, nil
+}
 
-	jsonBytes, err := json.Marshal(project)
+// 检查agent的权限，缺少权限的资源跳过不采集
+func (v2 *Agent) checkAccess() {
+	access, err := rbac.SelfCheck(v2.clientSet, Rules, v2.opt.Namespaces)
 	if err != nil {
-		tool.Log.Error(err)
+		v2.log.WithError(err).Warn("权限检查失败，按拥有全部权限处理")
+		return
+	}
+	denied := access.DeniedStrings()
+	if len(denied) > 0 {
+		v2.log.WithField("missing", denied).Warn("缺少权限，相关资源将不会采集")
+	}
+
+	v2.mutex.Lock()
+	v2.access = access
+	v2.mutex.Unlock()
+	v2.health.SetMissingPermissions(denied)
+}
+
+// 是否拥有资源在namespace里的全部动作权限
+func (v2 *Agent) allowed(name, namespace string, verbs ...string) bool {
+	v2.mutex.RLock()
+	defer v2.mutex.RUnlock()
+	for _, verb := range verbs {
+		if !v2.access.Allowed(name, namespace, verb) {
+			return false
+		}
 	}
+	return true
+}
 
-	success := tool.RegCluster(string(jsonBytes), v2.siteUrl)
-	return success
+// 计算全量数据的hash，只包含精简数据结构中的字段并忽略resourceVersion，
+// 心跳和状态更新时间这类每次都会变化的字段不影响hash
+func projectHash(project *Project) string {
+	nodes := make([]schema.Node, 0, len(project.Nodes))
+	for i := range project.Nodes {
+		nodes = append(nodes, schema.NewNode(&project.Nodes[i]))
+	}
+	hash, err := schema.ProjectHash(project.ClusterName, project.Cloud, slimNamespaces(project.Namespaces), nodes)
+	if err != nil {
+		tool.Log.Error(err)
+		return ""
+	}
+	return hash
 }
 
 // 接收channel发送数据
 func (v2 *Agent) startGetChannel() {
-loop:
+	defer v2.closer.Done()
+	defer func() {
+		// 不再接收watch数据，直接关闭所有watch
+		if r := recover(); r != nil {
+			v2.pipe.Fail(r)
+			v2.shutdown()
+		}
+	}()
 	for {
 		select {
 		case e := <-v2.watchDeploymentChannel:
-			tool.Log.Infof("%s deployment,Name: %s,NameSpace: %s", e.Type, e.Deployment.Name, e.Namespace)
-			watchProject := &WatchProject{
-				ClusterName:  v2.clusterName,
-				Type:         e.Type,
-				Timestamp:    time.Now().Unix(),
-				ResourceType: "Deployment",
-				Namespaces: []Namespace{
+			v2.pipe.Dispatch(pipeline.Event{Resource: "Deployment", Type: e.Type, Object: e.Deployment, Data: e})
+		case e := <-v2.watchStatefulSetChannel:
+			v2.pipe.Dispatch(pipeline.Event{Resource: "StatefulSet", Type: e.Type, Object: e.StatefulSet, Data: e})
+		case e := <-v2.watchNodeChannel:
+			v2.pipe.Dispatch(pipeline.Event{Resource: "Node", Type: e.Type, Object: e.Node, Data: e})
+		case <-v2.closeWatchChannel:
+			v2.shutdown()
+			v2.log.Info("正在关闭数据发送通道")
+			return
+		}
+	}
+}
+
+// 关闭所有watch、全量同步和发送流程
+func (v2 *Agent) shutdown() {
+	v2.mutex.Lock()
+	if !v2.closed {
+		v2.closed = true
+		close(v2.closeWatchDeploymentChannel)
+		close(v2.watchDeploymentChannel)
+		close(v2.closeWatchStatefulSetChannel)
+		close(v2.watchStatefulSetChannel)
+		v2.closeWatchNodeChannel <- 1
+		close(v2.watchNodeChannel)
+		v2.closeResyncChannel <- 1
+	}
+	v2.mutex.Unlock()
+	v2.pipe.Stop()
+}
+
+// 处理一个事件，合并后的事件类型以 e.Type 为准
+func (v2 *Agent) process(e pipeline.Event, seq *event.Sequencer) {
+	switch data := e.Data.(type) {
+	case WatchDepData:
+		data.Type = e.Type
+		v2.handleDeployment(data, seq)
+	case WatchStatefulData:
+		data.Type = e.Type
+		v2.handleStatefulSet(data, seq)
+	case WatchNodeData:
+		data.Type = e.Type
+		v2.handleNode(data, seq)
+	}
+}
+
+func (v2 *Agent) handleDeployment(e WatchDepData, seq *event.Sequencer) {
+	v2.log.WithFields(logrus.Fields{
+		tool.FieldResource:  "Deployment",
+		tool.FieldNamespace: e.Namespace,
+		tool.FieldName:      e.Deployment.Name,
+		tool.FieldEvent:     e.Type,
+	}).Info("收到watch事件")
+	v2.redactWorkload(&e.Deployment.ObjectMeta, &e.Deployment.Spec.Template)
+	pods, cerr := v2.getPod(e.Namespace, e.Deployment.Spec.Selector.MatchLabels)
+	watchProject := &WatchProject{
+		ClusterName:  v2.clusterName,
+		Type:         e.Type,
+		Timestamp:    time.Now().Unix(),
+		ResourceType: "Deployment",
+		Namespaces: []Namespace{
+			{
+				Name: e.Namespace,
+				Deployments: []Deployment{
 					{
-						Name: e.Namespace,
-						Deployments: []Deployment{
-							{
-								Data: *e.Deployment,
-								Pods: v2.getPod(e.Namespace, e.Deployment.Spec.Selector.MatchLabels),
-							},
-						},
+						Data: *e.Deployment,
+						Pods: pods,
 					},
 				},
-			}
+			},
+		},
+	}
 
-			jsonBytes, err := json.Marshal(watchProject)
-			if err != nil {
-				tool.Log.Error(err)
-			}
+	if cerr != nil {
+		watchProject.Failures = []collect.Failure{cerr.Failure()}
+	}
+	v2.inventoryWorkload(watchProject, cerr == nil)
+	obj, full := v2.watchPayload(watchProject)
+	v2.pipe.SendObject(watchProject.ResourceType, e.Deployment, e.Type, obj, full, cerr == nil, seq)
+}
 
-			tool.HttpPostForm(string(jsonBytes), v2.siteUrl, e.Type)
-		case e := <-v2.watchStatefulSetChannel:
-			tool.Log.Infof("%s statefulSet,Name: %s,NameSpace: %s", e.Type, e.StatefulSet.Name, e.Namespace)
-			watchProject := &WatchProject{
-				ClusterName:  v2.clusterName,
-				Type:         e.Type,
-				Timestamp:    time.Now().Unix(),
-				ResourceType: "StatefulSet",
-				Namespaces: []Namespace{
+func (v2 *Agent) handleStatefulSet(e WatchStatefulData, seq *event.Sequencer) {
+	v2.log.WithFields(logrus.Fields{
+		tool.FieldResource:  "StatefulSet",
+		tool.FieldNamespace: e.Namespace,
+		tool.FieldName:      e.StatefulSet.Name,
+		tool.FieldEvent:     e.Type,
+	}).Info("收到watch事件")
+	v2.redactWorkload(&e.StatefulSet.ObjectMeta, &e.StatefulSet.Spec.Template)
+	pods, cerr := v2.getPod(e.Namespace, e.StatefulSet.Spec.Selector.MatchLabels)
+	watchProject := &WatchProject{
+		ClusterName:  v2.clusterName,
+		Type:         e.Type,
+		Timestamp:    time.Now().Unix(),
+		ResourceType: "StatefulSet",
+		Namespaces: []Namespace{
+			{
+				Name: e.Namespace,
+				StatefulSets: []StatefulSet{
 					{
-						Name: e.Namespace,
-						StatefulSets: []StatefulSet{
-							{
-								Data: *e.StatefulSet,
-								Pods: v2.getPod(e.Namespace, e.StatefulSet.Spec.Selector.MatchLabels),
-							},
-						},
+						Data: *e.StatefulSet,
+						Pods: pods,
 					},
 				},
-			}
-
-			jsonBytes, err := json.Marshal(watchProject)
-			if err != nil {
-				tool.Log.Error(err)
-			}
-
-			tool.HttpPostForm(string(jsonBytes), v2.siteUrl, e.Type)
-		case e := <-v2.watchNodeChannel:
-			tool.Log.Infof("%s Node,Addresses: %s", e.Type, e.Node.Status.Addresses)
-			watchNode := &WatchNode{
-				ClusterName:  v2.clusterName,
-				Type:         e.Type,
-				Timestamp:    time.Now().Unix(),
-				ResourceType: "Node",
-				Node:         *e.Node,
-			}
-
-			jsonBytes, err := json.Marshal(watchNode)
-			if err != nil {
-				tool.Log.Error(err)
-			}
+			},
+		},
+	}
 
-			tool.HttpPostForm(string(jsonBytes), v2.siteUrl, e.Type)
-		case <-v2.closeWatchChannel:
-			v2.mutex.Lock()
-
-			if !v2.closed {
-				v2.closed = true
-				v2.closeWatchDeploymentChannel <- 1
-				close(v2.watchDeploymentChannel)
-				v2.closeWatchStatefulSetChannel <- 1
-				close(v2.watchStatefulSetChannel)
-				v2.closeWatchNodeChannel <- 1
-				close(v2.watchNodeChannel)
-			}
+	if cerr != nil {
+		watchProject.Failures = []collect.Failure{cerr.Failure()}
+	}
+	v2.inventoryWorkload(watchProject, cerr == nil)
+	obj, full := v2.watchPayload(watchProject)
+	v2.pipe.SendObject(watchProject.ResourceType, e.StatefulSet, e.Type, obj, full, cerr == nil, seq)
+}
 
-			v2.mutex.Unlock()
-			tool.Log.Info("正在关闭数据发送通道")
-			break loop
-		}
+func (v2 *Agent) handleNode(e WatchNodeData, seq *event.Sequencer) {
+	v2.log.WithFields(logrus.Fields{
+		tool.FieldResource: "Node",
+		tool.FieldName:     e.Node.Name,
+		tool.FieldEvent:    e.Type,
+		"addresses":        e.Node.Status.Addresses,
+	}).Info("收到watch事件")
+	v2.opt.Redact.Node(e.Node)
+	watchNode := &WatchNode{
+		ClusterName:  v2.clusterName,
+		Type:         e.Type,
+		Timestamp:    time.Now().Unix(),
+		ResourceType: "Node",
+		Node:         *e.Node,
 	}
-	v2.closer.Done()
+
+	v2.inventoryNode(watchNode)
+	obj, full := v2.watchNodePayload(watchNode)
+	v2.pipe.SendObject(watchNode.ResourceType, e.Node, e.Type, obj, full, true, seq)
 }
 
-// 监听资源变化
-func (v2 *Agent) startWatchDeployment() {
+// 循环执行watch，watch出错时退避重试，关闭时退出
+func (v2 *Agent) keepWatching(resource, namespace string, handler func() error) {
+	log := v2.log.WithFields(logrus.Fields{
+		tool.FieldResource:  resource,
+		tool.FieldNamespace: namespace,
+	})
+	if !v2.allowed(resource, namespace, "list", "watch") {
+		log.Warn("缺少权限，跳过watch")
+		v2.health.WatchSkipped(watchKey(resource, namespace))
+		return
+	}
+	b := backoff.NewBackoff(time.Second, time.Minute)
+	failures := 0
 	for {
-		if err := v2.watchDepHandler(); err == nil {
-			tool.Log.Info("watch deployment is stop! restart now...")
-		} else {
-			tool.Log.Info("正在关闭DeploymentWatch")
+		err := handler()
+		if err == io.ErrClosedPipe || v2.isClosed() {
+			log.Info("正在关闭watch")
 			break
 		}
+		if err != nil {
+			failures++
+			wait := b.Duration(failures)
+			log.WithError(err).WithField("wait", wait.String()).Warn("watch失败，稍后重试")
+			time.Sleep(wait)
+			continue
+		}
+		failures = 0
+		log.Info("watch已断开，正在重启")
+		metrics.WatchRestarts.WithLabelValues(v2.clusterName, resource).Inc()
 	}
+}
+
+func (v2 *Agent) isClosed() bool {
+	v2.mutex.RLock()
+	defer v2.mutex.RUnlock()
+	return v2.closed
+}
+
+// 记录采集失败的日志和指标
+func (v2 *Agent) collectError(cerr *collect.Error) *collect.Error {
+	metrics.CollectErrors.WithLabelValues(v2.clusterName, cerr.Resource, string(cerr.Reason)).Inc()
+	v2.log.WithError(cerr.Err).WithFields(logrus.Fields{
+		tool.FieldResource:  cerr.Resource,
+		tool.FieldNamespace: cerr.Namespace,
+		"reason":            cerr.Reason,
+	}).Warn("获取数据失败")
+	return cerr
+}
+
+// 监听资源变化
+func (v2 *Agent) startWatchDeployment(namespace string) {
+	v2.keepWatching("Deployment", namespace, func() error {
+		return v2.watchDepHandler(namespace)
+	})
 	v2.closer.Done()
 }
 
-func (v2 *Agent) startWatchStatefulSet() {
-	for {
-		if err := v2.watchStatefulHandler(); err == nil {
-			tool.Log.Info("watch statefulset is stop! restart now...")
-		} else {
-			tool.Log.Info("正在关闭StatefulSetWatch")
-			break
-		}
-	}
+func (v2 *Agent) startWatchStatefulSet(namespace string) {
+	v2.keepWatching("StatefulSet", namespace, func() error {
+		return v2.watchStatefulHandler(namespace)
+	})
 	v2.closer.Done()
 }
 
 func (v2 *Agent) startWatchNode() {
-	for {
-		if err := v2.watchNodeHandler(); err == nil {
-			tool.Log.Info("watch node is stop! restart now...")
-		} else {
-			tool.Log.Info("正在关闭NodeWatch")
-			break
-		}
-	}
+	v2.keepWatching("Node", metav1.NamespaceAll, v2.watchNodeHandler)
 	v2.closer.Done()
 }
 
 // watch handler
-func (v2 *Agent) watchDepHandler() error {
+func (v2 *Agent) watchDepHandler(namespace string) (err error) {
 	defer func() {
-		err := recover()
-		if err != nil {
-			tool.Log.Error(err)
+		if r := recover(); r != nil {
+			v2.log.Error(r)
+			err = fmt.Errorf("%v", r)
 		}
 	}()
 
-	tool.Log.Info("正在监听deployment...")
-	deploymentsClient := v2.clientSet.AppsV1beta2().Deployments(metav1.NamespaceAll)
-
-	list, _ := deploymentsClient.List(metav1.ListOptions{})
+	v2.log.WithFields(logrus.Fields{
+		tool.FieldResource:  "Deployment",
+		tool.FieldNamespace: namespace,
+	}).Info("正在监听...")
+	deploymentsClient := v2.clientSet.AppsV1beta2().Deployments(namespace)
+
+	var list *v1beta2.DeploymentList
+	if cerr := collect.Retry(v2.opt.CollectRetries, "Deployment", namespace, func() (err error) {
+		list, err = deploymentsClient.List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return v2.collectError(cerr)
+	}
 	items := list.Items
 
 	timeoutSeconds := int64((15 * time.Minute).Seconds())
@@ -239,8 +551,14 @@ func (v2 *Agent) watchDepHandler() error {
 		TimeoutSeconds: &timeoutSeconds,
 		Watch: true,
 	}
-	w, _ := deploymentsClient.Watch(options)
+	w, err := deploymentsClient.Watch(options)
+	if err != nil {
+		return v2.collectError(collect.NewError("Deployment", namespace, err))
+	}
 	defer w.Stop()
+	key := watchKey("Deployment", namespace)
+	v2.health.WatchEstablished(key)
+	defer v2.health.WatchStopped(key)
 
 	// 为了第一次不发送数据，启动watch第一次会输出所有的数据
 	count := 0
@@ -252,21 +570,32 @@ loop:
 		case e, ok := <-w.ResultChan():
 			if !ok {
 				break loop
-			} else if e.Type == watch.Added || e.Type == watch.Deleted || e.Type == watch.Modified {
+			}
+			v2.health.WatchProgress(key)
+			if e.Type == watch.Error {
+				return v2.collectError(collect.NewError("Deployment", namespace, apierrors.FromObject(e.Object)))
+			}
+			if e.Type == watch.Added || e.Type == watch.Deleted || e.Type == watch.Modified {
 				if count != len(items) {
 					count += 1
 				} else {
+					metrics.EventsSeen.WithLabelValues(v2.clusterName, "Deployment", string(e.Type)).Inc()
 					// go的断言获取运行时的struct
-					nname := e.Object.(*v1beta2.Deployment).Namespace
-					if nname != "default" && nname != "kube-system" &&
-						nname != "kube-public" && nname != "local" && nname != "tools" &&
-						!v2.regExp.MatchString(nname) {
+					deployment, ok := e.Object.(*v1beta2.Deployment)
+					if !ok {
+						v2.collectError(collect.NewConversionError("Deployment", "", e.Object))
+						continue
+					}
+					nname := deployment.Namespace
+					if v2.included(nname) {
 						data := WatchDepData{
-							Deployment: e.Object.(*v1beta2.Deployment),
-							Namespace:  e.Object.(*v1beta2.Deployment).Namespace,
+							Deployment: deployment,
+							Namespace:  nname,
 							Type:       e.Type,
 						}
 						v2.watchDeploymentChannel <- data
+					} else {
+						metrics.EventsDropped.WithLabelValues(v2.clusterName, "Deployment", string(e.Type), metrics.DropFiltered).Inc()
 					}
 				}
 			}
@@ -281,17 +610,26 @@ loop:
 	return nil
 }
 
-func (v2 *Agent) watchStatefulHandler() error {
+func (v2 *Agent) watchStatefulHandler(namespace string) (err error) {
 	defer func() {
-		err := recover()
-		if err != nil {
-			tool.Log.Error(err)
+		if r := recover(); r != nil {
+			v2.log.Error(r)
+			err = fmt.Errorf("%v", r)
 		}
 	}()
-	tool.Log.Info("正在监听statefulset...")
-	statefulSetClient := v2.clientSet.AppsV1beta2().StatefulSets(metav1.NamespaceAll)
-
-	list, _ := statefulSetClient.List(metav1.ListOptions{})
+	v2.log.WithFields(logrus.Fields{
+		tool.FieldResource:  "StatefulSet",
+		tool.FieldNamespace: namespace,
+	}).Info("正在监听...")
+	statefulSetClient := v2.clientSet.AppsV1beta2().StatefulSets(namespace)
+
+	var list *v1beta2.StatefulSetList
+	if cerr := collect.Retry(v2.opt.CollectRetries, "StatefulSet", namespace, func() (err error) {
+		list, err = statefulSetClient.List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return v2.collectError(cerr)
+	}
 	items := list.Items
 
 	timeoutSeconds := int64((15 * time.Minute).Seconds())
@@ -299,8 +637,14 @@ func (v2 *Agent) watchStatefulHandler() error {
 		TimeoutSeconds: &timeoutSeconds,
 		Watch: true,
 	}
-	w, _ := statefulSetClient.Watch(options)
+	w, err := statefulSetClient.Watch(options)
+	if err != nil {
+		return v2.collectError(collect.NewError("StatefulSet", namespace, err))
+	}
 	defer w.Stop()
+	key := watchKey("StatefulSet", namespace)
+	v2.health.WatchEstablished(key)
+	defer v2.health.WatchStopped(key)
 
 	// 为了第一次不发送数据，启动watch第一次会输出所有的数据
 	count := 0
@@ -312,21 +656,32 @@ loop:
 		case e, ok := <-w.ResultChan():
 			if !ok {
 				break loop
-			} else if e.Type == watch.Added || e.Type == watch.Deleted || e.Type == watch.Modified {
+			}
+			v2.health.WatchProgress(key)
+			if e.Type == watch.Error {
+				return v2.collectError(collect.NewError("StatefulSet", namespace, apierrors.FromObject(e.Object)))
+			}
+			if e.Type == watch.Added || e.Type == watch.Deleted || e.Type == watch.Modified {
 				if count != len(items) {
 					count += 1
 				} else {
+					metrics.EventsSeen.WithLabelValues(v2.clusterName, "StatefulSet", string(e.Type)).Inc()
 					// go的断言获取运行时的struct
-					nname := e.Object.(*v1beta2.StatefulSet).Namespace
-					if nname != "default" && nname != "kube-system" &&
-						nname != "kube-public" && nname != "local" && nname != "tools" &&
-						!v2.regExp.MatchString(nname) {
+					statefulSet, ok := e.Object.(*v1beta2.StatefulSet)
+					if !ok {
+						v2.collectError(collect.NewConversionError("StatefulSet", "", e.Object))
+						continue
+					}
+					nname := statefulSet.Namespace
+					if v2.included(nname) {
 						data := WatchStatefulData{
-							StatefulSet: e.Object.(*v1beta2.StatefulSet),
-							Namespace:   e.Object.(*v1beta2.StatefulSet).Namespace,
+							StatefulSet: statefulSet,
+							Namespace:   nname,
 							Type:        e.Type,
 						}
 						v2.watchStatefulSetChannel <- data
+					} else {
+						metrics.EventsDropped.WithLabelValues(v2.clusterName, "StatefulSet", string(e.Type), metrics.DropFiltered).Inc()
 					}
 				}
 			}
@@ -341,17 +696,23 @@ loop:
 	return nil
 }
 
-func (v2 *Agent) watchNodeHandler() error {
+func (v2 *Agent) watchNodeHandler() (err error) {
 	defer func() {
-		err := recover()
-		if err != nil {
-			tool.Log.Error(err)
+		if r := recover(); r != nil {
+			v2.log.Error(r)
+			err = fmt.Errorf("%v", r)
 		}
 	}()
-	tool.Log.Info("正在监听node...")
+	v2.log.WithField(tool.FieldResource, "Node").Info("正在监听...")
 	nodesClient := v2.clientSet.CoreV1().Nodes()
 
-	list, _ := nodesClient.List(metav1.ListOptions{})
+	var list *corev1.NodeList
+	if cerr := collect.Retry(v2.opt.CollectRetries, "Node", metav1.NamespaceAll, func() (err error) {
+		list, err = nodesClient.List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return v2.collectError(cerr)
+	}
 	items := list.Items
 
 	timeoutSeconds := int64((15 * time.Minute).Seconds())
@@ -359,8 +720,13 @@ func (v2 *Agent) watchNodeHandler() error {
 		TimeoutSeconds: &timeoutSeconds,
 		Watch: true,
 	}
-	w, _ := nodesClient.Watch(options)
+	w, err := nodesClient.Watch(options)
+	if err != nil {
+		return v2.collectError(collect.NewError("Node", metav1.NamespaceAll, err))
+	}
 	defer w.Stop()
+	v2.health.WatchEstablished("Node")
+	defer v2.health.WatchStopped("Node")
 
 	// 为了第一次不发送数据，启动watch第一次会输出所有的数据
 	count := 0
@@ -372,12 +738,23 @@ loop:
 		case e, ok := <-w.ResultChan():
 			if !ok {
 				break loop
-			} else if e.Type == watch.Added || e.Type == watch.Deleted {
+			}
+			v2.health.WatchProgress("Node")
+			if e.Type == watch.Error {
+				return v2.collectError(collect.NewError("Node", metav1.NamespaceAll, apierrors.FromObject(e.Object)))
+			}
+			if e.Type == watch.Added || e.Type == watch.Deleted {
 				if count != len(items) {
 					count += 1
 				} else {
+					metrics.EventsSeen.WithLabelValues(v2.clusterName, "Node", string(e.Type)).Inc()
+					node, ok := e.Object.(*corev1.Node)
+					if !ok {
+						v2.collectError(collect.NewConversionError("Node", "", e.Object))
+						continue
+					}
 					data := WatchNodeData{
-						Node: e.Object.(*corev1.Node),
+						Node: node,
 						Type: e.Type,
 					}
 					v2.watchNodeChannel <- data
@@ -394,87 +771,173 @@ loop:
 	return nil
 }
 
+// 获取需要采集的namespace，配置了namespace时不再获取namespace列表
+func (v2 *Agent) getNamespaceNames() ([]string, error) {
+	if len(v2.opt.Namespaces) > 0 {
+		return v2.opt.Namespaces, nil
+	}
+	if !v2.allowed("Namespace", metav1.NamespaceAll, "list") {
+		v2.log.Warn("缺少namespace权限，跳过项目数据")
+		return nil, nil
+	}
+
+	var namespaceItems *corev1.NamespaceList
+	if cerr := collect.Retry(v2.opt.CollectRetries, "Namespace", "", func() (err error) {
+		namespaceItems, err = v2.clientSet.CoreV1().Namespaces().List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return nil, v2.collectError(cerr)
+	}
+
+	var names []string
+	for i := range namespaceItems.Items {
+		names = append(names, namespaceItems.Items[i].Name)
+	}
+	return names, nil
+}
+
 // 获取Resource
-func (v2 *Agent) getResourceWithNamespace() []Namespace {
-	tool.Log.Info("正在获取项目数据...")
+// namespace列表获取失败时返回error，其他资源获取失败记录在failures里
+func (v2 *Agent) getResourceWithNamespace() ([]Namespace, []collect.Failure, error) {
+	v2.log.Info("正在获取项目数据...")
 	var ns []Namespace
+	var failures []collect.Failure
 
-	namespaceItems, _ := v2.clientSet.CoreV1().Namespaces().List(metav1.ListOptions{})
-	nitems := namespaceItems.Items
+	nitems, err := v2.getNamespaceNames()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for i := range nitems {
+	for _, nname := range nitems {
 		// 收集deployment
-		nname := nitems[i].Name
-		if nname == "default" || nname == "kube-system" || nname == "kube-public" ||
-			nname == "local" || nname == "tools" || v2.regExp.MatchString(nname) {
+		if !v2.included(nname) {
 			continue
 		}
 		var ss []StatefulSet
 		var ds []Deployment
 
-		deploymentsClient, _ := v2.clientSet.AppsV1beta2().Deployments(nname).List(metav1.ListOptions{})
+		deploymentsClient := &v1beta2.DeploymentList{}
+		if v2.allowed("Deployment", nname, "list") {
+			if cerr := collect.Retry(v2.opt.CollectRetries, "Deployment", nname, func() (err error) {
+				deploymentsClient, err = v2.clientSet.AppsV1beta2().Deployments(nname).List(metav1.ListOptions{})
+				return err
+			}); cerr != nil {
+				failures = append(failures, v2.collectError(cerr).Failure())
+				deploymentsClient = &v1beta2.DeploymentList{}
+			}
+		}
 		ditems := deploymentsClient.Items
 
 		if len(ditems) == 0 {
-			tool.Log.Infof("namespace: %s has no deployment", nname)
+			v2.log.WithFields(logrus.Fields{
+				tool.FieldResource:  "Deployment",
+				tool.FieldNamespace: nname,
+			}).Debug("namespace下没有数据")
 		} else {
 			for q := range ditems {
 				o := ditems[q]
+				v2.redactWorkload(&o.ObjectMeta, &o.Spec.Template)
 
-				ps := v2.getPod(nname, o.Spec.Selector.MatchLabels)
+				ps, cerr := v2.getPod(nname, o.Spec.Selector.MatchLabels)
+				if cerr != nil {
+					failures = append(failures, cerr.Failure())
+				}
 				ds = append(ds, Deployment{Data: o, Pods: ps})
 			}
 		}
 
 		// 收集statefulset
-		statefulsetsClient, _ := v2.clientSet.AppsV1beta2().StatefulSets(nname).List(metav1.ListOptions{})
+		statefulsetsClient := &v1beta2.StatefulSetList{}
+		if v2.allowed("StatefulSet", nname, "list") {
+			if cerr := collect.Retry(v2.opt.CollectRetries, "StatefulSet", nname, func() (err error) {
+				statefulsetsClient, err = v2.clientSet.AppsV1beta2().StatefulSets(nname).List(metav1.ListOptions{})
+				return err
+			}); cerr != nil {
+				failures = append(failures, v2.collectError(cerr).Failure())
+				statefulsetsClient = &v1beta2.StatefulSetList{}
+			}
+		}
 		sitems := statefulsetsClient.Items
 		if len(sitems) == 0 {
-			tool.Log.Infof("namespace: %s has no statefulsets", nname)
+			v2.log.WithFields(logrus.Fields{
+				tool.FieldResource:  "StatefulSet",
+				tool.FieldNamespace: nname,
+			}).Debug("namespace下没有数据")
 		} else {
 			for q := range sitems {
 				o := sitems[q]
+				v2.redactWorkload(&o.ObjectMeta, &o.Spec.Template)
 
-				ps := v2.getPod(nname, o.Spec.Selector.MatchLabels)
+				ps, cerr := v2.getPod(nname, o.Spec.Selector.MatchLabels)
+				if cerr != nil {
+					failures = append(failures, cerr.Failure())
+				}
 				ss = append(ss, StatefulSet{Data: o, Pods: ps})
 			}
 		}
 
 		ns = append(ns, Namespace{Name: nname, Deployments: ds, StatefulSets: ss})
 	}
-	tool.Log.Info("获取项目数据完成...")
-	return ns
+	v2.log.WithField("failures", len(failures)).Info("获取项目数据完成...")
+	return ns, failures, nil
 }
 
-func (v2 *Agent) getPod(namespace string, labelSelector map[string]string) []Pod {
-	pods, _ := v2.clientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{
-		LabelSelector: labels.Set(labelSelector).String(),
-	})
+// 发送前对Deployment、StatefulSet脱敏，需要在计算hash和diff之前
+func (v2 *Agent) redactWorkload(meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec) {
+	v2.opt.Redact.Meta(meta)
+	v2.opt.Redact.PodTemplate(template)
+}
+
+func (v2 *Agent) getPod(namespace string, labelSelector map[string]string) ([]Pod, *collect.Error) {
+	if !v2.allowed("Pod", namespace, "list") {
+		return nil, nil
+	}
+	var pods *corev1.PodList
+	if cerr := collect.Retry(v2.opt.CollectRetries, "Pod", namespace, func() (err error) {
+		pods, err = v2.clientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{
+			LabelSelector: labels.Set(labelSelector).String(),
+		})
+		return err
+	}); cerr != nil {
+		return nil, v2.collectError(cerr)
+	}
 	items := pods.Items
 	var ps []Pod
 
 	for i := range items {
 		o := items[i]
+		v2.opt.Redact.Pod(&o)
 		var cs []Container
 		for q := range o.Spec.Containers {
 			cs = append(cs, Container{Data: o.Spec.Containers[q]})
 		}
 		ps = append(ps, Pod{Data: o, Containers: cs})
 	}
-	return ps
+	return ps, nil
 }
 
-func (v2 *Agent) getNode() []corev1.Node {
-	tool.Log.Info("正在获取Node数据...")
+func (v2 *Agent) getNode() ([]corev1.Node, *collect.Error) {
+	v2.log.Info("正在获取Node数据...")
 	var nodes []corev1.Node
+	if !v2.allowed("Node", metav1.NamespaceAll, "list") {
+		v2.log.Warn("缺少node权限，跳过Node数据")
+		return nodes, nil
+	}
 
 	nodesClient := v2.clientSet.CoreV1().Nodes()
-	list, _ := nodesClient.List(metav1.ListOptions{})
+	var list *corev1.NodeList
+	if cerr := collect.Retry(v2.opt.CollectRetries, "Node", "", func() (err error) {
+		list, err = nodesClient.List(metav1.ListOptions{})
+		return err
+	}); cerr != nil {
+		return nil, v2.collectError(cerr)
+	}
 	items := list.Items
 
 	for _, v := range items {
+		v2.opt.Redact.Node(&v)
 		nodes = append(nodes, v)
 	}
-	tool.Log.Info("获取Node数据完成...")
-	return nodes
+	v2.log.Info("获取Node数据完成...")
+	return nodes, nil
 }
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"kappagent/kapp"
+	"kappagent/kapp/inventory"
+	"kappagent/util/health"
+	"kappagent/util/k8s"
+	"kappagent/util/metrics"
+	"kappagent/util/server"
+	"kappagent/util/sink"
 	"kappagent/util/tool"
 	"os"
 	"regexp"
@@ -11,12 +19,16 @@ const (
 	envClusterName = "CLUSTER_NAME"
 	envSiteUrl     = "SITE_URL"
 	envCloud       = "CLOUD"
+	envListenAddr  = "LISTEN_ADDR"
+	// 多集群配置文件，设置后忽略CLUSTER_NAME
+	envClustersConfig = "CLUSTERS_CONFIG"
 )
 
 var (
 	clusterName = "default-cluster"
 	cloud       = "default-cloud"
 	siteUrl     = "http://localhost:3000/cluster"
+	listenAddr  = ":8080"
 	//siteUrl          = "http://192.168.104.73:8000/api/k8s/k8sync/"
 	//siteUrl          = "http://192.168.220.70:30626/api/k8s/k8sync/"
 	regExp, _ = regexp.Compile("^(c|p|u|user|cattle)-")
@@ -29,6 +41,17 @@ func main() {
 			tool.Log.Error(err)
 		}
 	}()
+
+	// 输出agent需要的最小权限ClusterRole
+	if len(os.Args) > 1 && os.Args[1] == "clusterrole" {
+		out, err := kapp.ClusterRoleYAML("kapp-agent")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Print(out)
+		return
+	}
+
 	if cn := os.Getenv(envClusterName); cn != "" {
 		//panic("请填写集群名称")
 		clusterName = os.Getenv(envClusterName)
@@ -44,7 +67,62 @@ func main() {
 		siteUrl = os.Getenv(envSiteUrl)
 	}
 
-	ks := kapp.NewKapp(clusterName, cloud, siteUrl, regExp)
+	if la := os.Getenv(envListenAddr); la != "" {
+		listenAddr = os.Getenv(envListenAddr)
+	}
+
+	// 输出将要上报的全量数据，不发送
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		if err := runSnapshot(os.Args[2:]); err != nil {
+			tool.Log.WithError(err).Error("生成快照失败")
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 重新发送记录的数据
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			tool.Log.WithError(err).Error("重放失败")
+			os.Exit(1)
+		}
+		return
+	}
+
+	k8s.AddFlags(flag.CommandLine)
+	flag.Parse()
+
+	s, err := sink.NewFromEnv(siteUrl)
+	if err != nil {
+		tool.Log.WithError(err).Error("初始化sink失败")
+		os.Exit(1)
+	}
+	defer s.Close()
+
+	var ks kapp.KappService
+	if path := os.Getenv(envClustersConfig); path != "" {
+		clusters, err := kapp.LoadClusters(path, cloud)
+		if err != nil {
+			tool.Log.WithError(err).Error("读取集群配置失败")
+			os.Exit(1)
+		}
+		ks = kapp.NewGroup(clusters, s, regExp)
+	} else {
+		clientSet, err := k8s.InitClient()
+		if err != nil {
+			tool.Log.WithError(err).Error("初始化client失败")
+			os.Exit(1)
+		}
+		ks = kapp.NewKapp(clientSet, clusterName, cloud, s, regExp)
+	}
+
+	server.Handle("/metrics", metrics.Handler())
+	server.Handle("/healthz", health.Handler(ks.Live))
+	server.Handle("/readyz", health.Handler(ks.Ready))
+	if inventory.Enabled() {
+		server.Handle("/v1/", inventory.Handler())
+	}
+	go server.Start(listenAddr)
 	//signalChan := make(chan os.Signal, 1)
 	//signal.Notify(signalChan,
 	//	os.Kill,
@@ -61,8 +139,12 @@ func main() {
 	//	}
 	//}()
 
-	ks.Run()
-
 	defer ks.Close()
+	if err := ks.Run(); err != nil {
+		tool.Log.WithError(err).Error("采集退出")
+		ks.Close()
+		s.Close()
+		os.Exit(1)
+	}
 	//defer tool.Log.Fatal(tool.KafkaWriter.Close())
 }
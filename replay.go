@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"kappagent/util/sink"
+	"kappagent/util/tool"
+	"os"
+	"time"
+)
+
+// replay 子命令：读取记录的jsonl数据，重新发送到指定的sink
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "JSONL file recorded by DRY_RUN=file, - for stdin")
+	sinkName := fs.String("sink", "http", "sink to send to: http | log | file | count")
+	target := fs.String("target", siteUrl, "report url for the http sink, file path for the file sink, defaults to SITE_URL")
+	rateLimit := fs.Float64("rate", 10, "max payloads per second, 0 means unlimited")
+	since := fs.String("since", "", "(optional) only replay payloads recorded at or after this RFC3339 time")
+	until := fs.String("until", "", "(optional) only replay payloads recorded at or before this RFC3339 time")
+	rename := fs.String("cluster-name", "", "(optional) rewrite the cluster name of every payload")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("缺少 --file 参数")
+	}
+
+	opt := sink.ReplayOptions{Rate: *rateLimit, ClusterName: *rename}
+	var err error
+	if opt.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if opt.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if *file != "-" {
+		if in, err = os.Open(*file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	s, err := sink.New(*sinkName, *target)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	result, err := sink.Replay(in, s, opt)
+	tool.Log.WithField("result", result).Info("重放结束")
+	if err != nil {
+		return err
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("%d条数据发送失败", result.Failed)
+	}
+	return nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"kappagent/kapp"
+	"kappagent/util/k8s"
+	"kappagent/util/tool"
+	"os"
+	"sigs.k8s.io/yaml"
+)
+
+// snapshot 子命令：生成与注册时相同的全量数据，输出到标准输出或文件
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	output := fs.String("output", "json", "output format: json | yaml")
+	file := fs.String("file", "", "(optional) write the snapshot to this file instead of stdout")
+	k8s.AddFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "json" && *output != "yaml" {
+		return fmt.Errorf("不支持的输出格式: %s", *output)
+	}
+	if *file == "" {
+		// 日志输出到标准错误，避免和快照混在一起
+		tool.Log.SetOutput(os.Stderr)
+	}
+
+	clientSet, err := k8s.InitClient()
+	if err != nil {
+		return err
+	}
+	project, err := kapp.Snapshot(clientSet, clusterName, cloud, regExp)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(project, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *output == "yaml" {
+		if data, err = yaml.JSONToYAML(data); err != nil {
+			return err
+		}
+	} else {
+		data = append(data, '\n')
+	}
+
+	if *file == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(*file, data, 0644)
+}
@@ -0,0 +1,63 @@
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Initial 小于该值时按该值计算，避免配置为0时变成没有间隔的重试
+const MinInitial = 100 * time.Millisecond
+
+// 带上限和抖动的指数退避
+type Backoff struct {
+	Initial time.Duration
+	// 0表示不设上限
+	Max        time.Duration
+	Multiplier float64
+	// 抖动比例(0~1)，实际等待时间在 [d*(1-Jitter), d] 之间随机
+	Jitter float64
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func NewBackoff(initial, max time.Duration) *Backoff {
+	return &Backoff{
+		Initial:    initial,
+		Max:        max,
+		Multiplier: 2,
+		Jitter:     0.5,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// 第 attempt 次失败后(从1开始)需要等待的时间
+func (b *Backoff) Duration(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := float64(b.Initial)
+	if d < float64(MinInitial) {
+		d = float64(MinInitial)
+	}
+	// 不设上限时也要在 time.Duration 的范围内
+	limit := float64(math.MaxInt64 / 2)
+	if b.Max > 0 {
+		limit = float64(b.Max)
+	}
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= b.Multiplier
+	}
+	if d > limit {
+		d = limit
+	}
+
+	if b.Jitter > 0 {
+		b.mutex.Lock()
+		d -= d * b.Jitter * b.rand.Float64()
+		b.mutex.Unlock()
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,58 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDurationGrowth(t *testing.T) {
+	b := NewBackoff(time.Second, 10*time.Second)
+	b.Jitter = 0
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := b.Duration(i + 1); got != w {
+			t.Fatalf("attempt %d: got %v, want %v", i+1, got, w)
+		}
+	}
+	if got := b.Duration(0); got != time.Second {
+		t.Fatalf("attempt 0 should count as the first: got %v", got)
+	}
+}
+
+func TestDurationUncapped(t *testing.T) {
+	b := NewBackoff(time.Second, 0)
+	b.Jitter = 0
+	if got := b.Duration(11); got != 1024*time.Second {
+		t.Fatalf("attempt 11: got %v, want %v", got, 1024*time.Second)
+	}
+	// 次数很大时不能溢出成负数
+	prev := time.Duration(0)
+	for attempt := 1; attempt < 200; attempt++ {
+		got := b.Duration(attempt)
+		if got < prev {
+			t.Fatalf("attempt %d: %v is less than the previous %v", attempt, got, prev)
+		}
+		prev = got
+	}
+}
+
+func TestDurationMinInitial(t *testing.T) {
+	b := NewBackoff(0, time.Second)
+	b.Jitter = 0
+	if got := b.Duration(1); got != MinInitial {
+		t.Fatalf("got %v, want %v", got, MinInitial)
+	}
+	if got := b.Duration(2); got != 2*MinInitial {
+		t.Fatalf("got %v, want %v", got, 2*MinInitial)
+	}
+}
+
+func TestDurationJitter(t *testing.T) {
+	b := NewBackoff(time.Second, time.Minute)
+	for i := 0; i < 100; i++ {
+		got := b.Duration(3)
+		if got < 2*time.Second || got > 4*time.Second {
+			t.Fatalf("jittered duration %v outside [2s, 4s]", got)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package health
+
+import (
+	"encoding/json"
+	"kappagent/util/tool"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 单个watch的状态
+type WatchStatus struct {
+	Established  bool      `json:"established"`
+	LastProgress time.Time `json:"lastProgress"`
+	// 缺少权限等原因没有启动的watch，不参与检查
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+type Status struct {
+	Watches      map[string]WatchStatus `json:"watches"`
+	LastSend     time.Time              `json:"lastSend"`
+	Pending      int                    `json:"pending"`
+	Threshold    string                 `json:"threshold"`
+	NotReady     []string               `json:"notReady,omitempty"`
+	NotLive      []string               `json:"notLive,omitempty"`
+	Registration interface{}            `json:"registration,omitempty"`
+	// 缺少的权限
+	MissingPermissions []string `json:"missingPermissions,omitempty"`
+}
+
+// 记录watch和发送协程的进度，用于存活和就绪检查
+type Tracker struct {
+	mutex     sync.RWMutex
+	watches   map[string]*WatchStatus
+	lastSend  time.Time
+	pending   func() int
+	threshold time.Duration
+	missing   []string
+}
+
+// resources 为需要监听的资源类型，threshold 为允许没有进展的最长时间
+func NewTracker(resources []string, threshold time.Duration, pending func() int) *Tracker {
+	now := time.Now()
+	watches := make(map[string]*WatchStatus, len(resources))
+	for _, r := range resources {
+		watches[r] = &WatchStatus{LastProgress: now}
+	}
+	return &Tracker{
+		watches:   watches,
+		lastSend:  now,
+		pending:   pending,
+		threshold: threshold,
+	}
+}
+
+// watch 建立成功
+func (t *Tracker) WatchEstablished(resource string) {
+	t.setWatch(resource, true)
+}
+
+// watch 断开
+func (t *Tracker) WatchStopped(resource string) {
+	t.setWatch(resource, false)
+}
+
+// 没有启动watch
+func (t *Tracker) WatchSkipped(resource string) {
+	t.mutex.Lock()
+	t.watches[resource] = &WatchStatus{Skipped: true, LastProgress: time.Now()}
+	t.mutex.Unlock()
+}
+
+// 记录权限检查中缺少的权限
+func (t *Tracker) SetMissingPermissions(missing []string) {
+	t.mutex.Lock()
+	t.missing = missing
+	t.mutex.Unlock()
+}
+
+// watch 收到事件
+func (t *Tracker) WatchProgress(resource string) {
+	t.mutex.Lock()
+	if w, ok := t.watches[resource]; ok {
+		w.LastProgress = time.Now()
+	}
+	t.mutex.Unlock()
+}
+
+func (t *Tracker) setWatch(resource string, established bool) {
+	t.mutex.Lock()
+	w, ok := t.watches[resource]
+	if !ok {
+		w = &WatchStatus{}
+		t.watches[resource] = w
+	}
+	w.Established = established
+	w.LastProgress = time.Now()
+	t.mutex.Unlock()
+}
+
+// 发送协程完成了一次发送(无论成功与否)
+func (t *Tracker) SendProgress() {
+	t.mutex.Lock()
+	t.lastSend = time.Now()
+	t.mutex.Unlock()
+}
+
+// 开始watch，从现在开始计算没有进展的时间
+func (t *Tracker) Start() {
+	now := time.Now()
+	t.mutex.Lock()
+	for _, w := range t.watches {
+		w.LastProgress = now
+	}
+	t.lastSend = now
+	t.mutex.Unlock()
+}
+
+func (t *Tracker) Status() Status {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	now := time.Now()
+	s := Status{
+		Watches:   make(map[string]WatchStatus, len(t.watches)),
+		LastSend:  t.lastSend,
+		Threshold: t.threshold.String(),
+
+		MissingPermissions: t.missing,
+	}
+	if t.pending != nil {
+		s.Pending = t.pending()
+	}
+
+	for r, w := range t.watches {
+		s.Watches[r] = *w
+		if w.Skipped {
+			continue
+		}
+		if !w.Established {
+			s.NotReady = append(s.NotReady, r)
+		}
+		if t.threshold > 0 && now.Sub(w.LastProgress) > t.threshold {
+			s.NotLive = append(s.NotLive, r)
+		}
+	}
+	// 队列里有数据但是长时间没有发送，说明发送协程卡住了
+	if t.threshold > 0 && s.Pending > 0 && now.Sub(t.lastSend) > t.threshold {
+		s.NotLive = append(s.NotLive, "sender")
+	}
+	sort.Strings(s.NotReady)
+	sort.Strings(s.NotLive)
+	return s
+}
+
+// 检查函数返回是否健康以及详细信息
+type CheckFunc func() (bool, interface{})
+
+// 健康返回200，否则返回503，body为json格式的详细信息
+func Handler(check CheckFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, detail := check()
+		w.Header().Set("Content-Type", "application/json")
+		if ok {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(detail); err != nil {
+			tool.Log.Error(err)
+		}
+	})
+}
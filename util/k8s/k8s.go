@@ -7,57 +7,84 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 	"kappagent/util/tool"
 	"os"
-	"path/filepath"
 )
 
 const (
-	envRunEnv = "RUN_ENV"
+	envClientQPS   = "CLIENT_QPS"
+	envClientBurst = "CLIENT_BURST"
 )
 
+// 命令行参数，通过AddFlags注册
 var (
-	runEnv = "DEV"
+	kubeConfig  string
+	kubeContext string
 )
 
-func init() {
-	if re := os.Getenv(envRunEnv); re != "" {
-		runEnv = os.Getenv(envRunEnv)
-	}
+// 注册 --kubeconfig 和 --context 参数
+func AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&kubeConfig, "kubeconfig", "", "(optional) path to the kubeconfig file, defaults to $KUBECONFIG or ~/.kube/config")
+	fs.StringVar(&kubeConfig, "kubeConfig", "", "deprecated, use --kubeconfig")
+	fs.StringVar(&kubeContext, "context", "", "(optional) kubeconfig context to use")
 }
 
-// 初始化k8s client
-func InitClient() *kubernetes.Clientset {
+// 初始化k8s client，使用命令行参数指定的kubeconfig和context
+func InitClient() (*kubernetes.Clientset, error) {
 	tool.Log.Info("初始化client...")
-	// 本地开发
-	var kConfig *rest.Config
-	if runEnv == "DEV" {
-		var kubeConfig *string
-		if home := tool.HomeDir(); home != "" {
-			kubeConfig = flag.String("kubeConfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeConfig file")
-		} else {
-			kubeConfig = flag.String("kubeConfig", "", "absolute path to the kubeConfig file")
-		}
-		flag.Parse()
-		config, err := clientcmd.BuildConfigFromFlags("", *kubeConfig)
-		if err != nil {
-			panic(err.Error())
-		}
-		kConfig = config
-	} else {
-		// 集群内部署
+	clientSet, err := NewClientFromContext(kubeConfig, kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	tool.Log.Info("初始化client成功...")
+	return clientSet, nil
+}
+
+// 加载client配置
+// 没有指定kubeconfig、context并且没有设置KUBECONFIG时，在集群内运行就使用ServiceAccount，
+// 否则按kubeconfig的标准规则加载(KUBECONFIG可以包含多个文件)
+func LoadConfig(kubeConfig, context string) (*rest.Config, error) {
+	if kubeConfig == "" && context == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
 		config, err := rest.InClusterConfig()
-		if err != nil {
-			panic("初始化config失败:" + err.Error())
+		if err == nil {
+			tool.Log.Info("使用集群内配置")
+			return config, nil
+		}
+		if err != rest.ErrNotInCluster {
+			return nil, err
 		}
-		kConfig = config
 	}
 
-	// 获取client
-	clientSet, err := kubernetes.NewForConfig(kConfig)
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeConfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+// 根据kubeconfig文件和其中的context创建client
+func NewClientFromContext(kubeConfig, context string) (*kubernetes.Clientset, error) {
+	config, err := LoadConfig(kubeConfig, context)
 	if err != nil {
-		panic("获取client失败:" + err.Error())
+		return nil, err
 	}
+	return newClient(config)
+}
 
-	tool.Log.Info("初始化client成功...")
+// 使用apiserver地址、token文件和CA证书创建client
+func NewClientFromToken(server, tokenFile, caFile string) (*kubernetes.Clientset, error) {
+	config := &rest.Config{
+		Host:            server,
+		BearerTokenFile: tokenFile,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: caFile},
+	}
+	return newClient(config)
+}
 
-	return clientSet
+// 大集群全量获取数据时默认的QPS(5)和Burst(10)太低，可以通过环境变量调整
+func newClient(config *rest.Config) (*kubernetes.Clientset, error) {
+	if qps := tool.EnvFloat(envClientQPS, 0); qps > 0 {
+		config.QPS = float32(qps)
+	}
+	if burst := tool.EnvInt(envClientBurst, 0); burst > 0 {
+		config.Burst = burst
+	}
+	return kubernetes.NewForConfig(config)
 }
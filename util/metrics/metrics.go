@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "kapp"
+
+// 事件被丢弃的原因
+const (
+	DropFiltered   = "filtered"
+	DropMarshal    = "marshal"
+	DropSendFailed = "send_failed"
+	DropQueueFull  = "queue_full"
+)
+
+// 发送指标中 resource、event 标签的取值，其他值统一记为 other，注册、全量同步和批量数据为空
+var (
+	sendResources = map[string]bool{"Deployment": true, "StatefulSet": true, "Node": true}
+	sendEvents    = map[string]bool{"ADDED": true, "MODIFIED": true, "DELETED": true}
+)
+
+var (
+	// watch 收到的事件数
+	EventsSeen = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_seen_total",
+		Help:      "Number of watch events received.",
+	}, []string{"cluster", "resource", "type"})
+
+	// 没有发送成功的事件数
+	EventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_dropped_total",
+		Help:      "Number of watch events that were not delivered.",
+	}, []string{"cluster", "resource", "type", "reason"})
+
+	// 合并窗口内被后续事件覆盖的事件数
+	EventsCoalesced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_coalesced_total",
+		Help:      "Number of watch events merged into a later event of the same object.",
+	}, []string{"cluster", "resource"})
+
+	// 每批发送的事件数
+	BatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "batch_size",
+		Help:      "Number of events sent in one batch.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"sink"})
+
+	// 发送耗时
+	SendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "send_duration_seconds",
+		Help:      "Latency of sending payloads to a sink.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"sink", "kind", "resource", "event"})
+
+	// 发送失败数
+	SendFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "send_failures_total",
+		Help:      "Number of failed sends per sink.",
+	}, []string{"sink", "kind", "resource", "event"})
+
+	// 发送队列中的数据条数
+	SinkQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sink_queue_depth",
+		Help:      "Number of payloads waiting in the in-memory send queue.",
+	}, []string{"sink", "cluster"})
+
+	// block 策略下等待队列空间的时间
+	SinkBlockedSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_blocked_seconds_total",
+		Help:      "Time producers spent waiting for space in a full send queue.",
+	}, []string{"sink", "cluster"})
+
+	// drop_oldest 策略下丢弃的数据条数
+	SinkDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_dropped_total",
+		Help:      "Number of queued payloads dropped to make room for newer ones.",
+	}, []string{"sink", "cluster"})
+
+	// spill 策略下写入磁盘的数据条数
+	SinkSpilled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_spilled_total",
+		Help:      "Number of payloads written to the spill file because the send queue was full.",
+	}, []string{"sink", "cluster"})
+
+	// spill 策略下从磁盘读回并发送的数据条数
+	SinkUnspilled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_unspilled_total",
+		Help:      "Number of payloads read back from the spill file.",
+	}, []string{"sink", "cluster"})
+
+	// 等待发送速率限制的时间
+	SinkRateLimitedSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_rate_limited_seconds_total",
+		Help:      "Time sends spent waiting for the outbound rate limit.",
+	}, []string{"sink"})
+
+	// 正在发送的请求数
+	SinkInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sink_inflight",
+		Help:      "Number of sends in progress.",
+	}, []string{"sink"})
+
+	// 已发送但还没有收到确认的数据条数
+	SinkUnacked = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sink_unacked",
+		Help:      "Number of payloads sent over a stream and not acknowledged yet.",
+	}, []string{"sink"})
+
+	// 重新建立连接的次数
+	SinkReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_reconnects_total",
+		Help:      "Number of times a streaming sink re-established its stream.",
+	}, []string{"sink"})
+
+	// 重连后重新发送的数据条数
+	SinkResent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_resent_total",
+		Help:      "Number of unacknowledged payloads resent after a reconnect.",
+	}, []string{"sink"})
+
+	// 集群注册次数
+	Registrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registrations_total",
+		Help:      "Number of cluster registration attempts by result.",
+	}, []string{"result"})
+
+	// 调用k8s接口失败次数
+	CollectErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "collect_errors_total",
+		Help:      "Number of failed Kubernetes API calls by reason.",
+	}, []string{"cluster", "resource", "reason"})
+
+	// watch 重启次数
+	WatchRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_restarts_total",
+		Help:      "Number of times a watch was re-established.",
+	}, []string{"cluster", "resource"})
+
+	// dry-run 模式下记录的数据条数
+	DryRunPayloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dryrun_payloads_total",
+		Help:      "Number of payloads recorded by the dry-run sink.",
+	}, []string{"cluster", "kind"})
+
+	// dry-run 模式下记录的数据字节数
+	DryRunBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dryrun_payload_bytes_total",
+		Help:      "Size of payloads recorded by the dry-run sink.",
+	}, []string{"cluster", "kind"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		EventsSeen,
+		EventsDropped,
+		EventsCoalesced,
+		BatchSize,
+		SendDuration,
+		SendFailures,
+		SinkQueueDepth,
+		SinkBlockedSeconds,
+		SinkDropped,
+		SinkSpilled,
+		SinkUnspilled,
+		SinkRateLimitedSeconds,
+		SinkInflight,
+		SinkUnacked,
+		SinkReconnects,
+		SinkResent,
+		Registrations,
+		WatchRestarts,
+		CollectErrors,
+		DryRunPayloads,
+		DryRunBytes,
+	)
+}
+
+// 发送指标的 resource、event 标签，取值有限
+func SendLabels(resource, event string) (string, string) {
+	return bounded(sendResources, resource), bounded(sendEvents, event)
+}
+
+func bounded(values map[string]bool, v string) string {
+	if v == "" || values[v] {
+		return v
+	}
+	return "other"
+}
+
+// 注册队列长度指标，f 返回当前队列中的事件数
+func RegisterQueueDepth(cluster, resource string, f func() int) error {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "queue_depth",
+		Help:        "Number of events waiting to be sent.",
+		ConstLabels: prometheus.Labels{"cluster": cluster, "resource": resource},
+	}, func() float64 {
+		return float64(f())
+	})
+	// 集群重启后重新注册，替换掉旧的
+	prometheus.Unregister(gauge)
+	return prometheus.Register(gauge)
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,220 @@
+package rotate
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupTimeFormat = "20060102-150405.000"
+	compressSuffix   = ".gz"
+)
+
+// 按大小/时间切割的文件writer
+type Writer struct {
+	// 文件路径，切割后的文件命名为 name-时间.ext
+	Filename string
+	// 单个文件最大字节数，0表示不按大小切割
+	MaxSize int64
+	// 文件打开超过该时间后切割，0表示不按时间切割
+	Interval time.Duration
+	// 切割后的文件保留时间，0表示不按时间清理
+	MaxAge time.Duration
+	// 切割后的文件最多保留个数，0表示不按个数清理
+	MaxBackups int
+	// 切割后的文件是否gzip压缩
+	Compress bool
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// 将数据刷到磁盘
+func (w *Writer) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// 立即切割
+func (w *Writer) Rotate() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.rotate()
+}
+
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.close()
+}
+
+func (w *Writer) shouldRotate(n int64) bool {
+	if w.MaxSize > 0 && w.size > 0 && w.size+n > w.MaxSize {
+		return true
+	}
+	if w.Interval > 0 && time.Since(w.openedAt) >= w.Interval {
+		return true
+	}
+	return false
+}
+
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.Filename), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	w.openedAt = time.Now()
+	return nil
+}
+
+func (w *Writer) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Writer) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(w.Filename); err == nil {
+		backup := w.backupName(time.Now())
+		if err := os.Rename(w.Filename, backup); err != nil {
+			return err
+		}
+		go w.afterRotate(backup)
+	}
+	return w.open()
+}
+
+// 压缩和清理旧文件，在后台执行
+func (w *Writer) afterRotate(backup string) {
+	if w.Compress {
+		if err := compressFile(backup); err == nil {
+			os.Remove(backup)
+		}
+	}
+	w.cleanup()
+}
+
+func (w *Writer) backupName(t time.Time) string {
+	dir, prefix, ext := w.parts()
+	return filepath.Join(dir, prefix+t.Format(backupTimeFormat)+ext)
+}
+
+func (w *Writer) parts() (dir, prefix, ext string) {
+	dir = filepath.Dir(w.Filename)
+	base := filepath.Base(w.Filename)
+	ext = filepath.Ext(base)
+	prefix = strings.TrimSuffix(base, ext) + "-"
+	return
+}
+
+// 按保留个数和保留时间删除切割后的旧文件
+func (w *Writer) cleanup() {
+	if w.MaxBackups <= 0 && w.MaxAge <= 0 {
+		return
+	}
+	dir, prefix, ext := w.parts()
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"*"))
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		path string
+		t    time.Time
+	}
+	var backups []backup
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), compressSuffix)
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{path: f, t: t})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].t.After(backups[j].t)
+	})
+
+	for i, b := range backups {
+		if (w.MaxBackups > 0 && i >= w.MaxBackups) || (w.MaxAge > 0 && time.Since(b.t) > w.MaxAge) {
+			os.Remove(b.path)
+		}
+	}
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path + compressSuffix)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		dst.Close()
+		os.Remove(path + compressSuffix)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
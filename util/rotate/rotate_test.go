@@ -0,0 +1,173 @@
+package rotate
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// 切割后的文件，按文件名(即切割时间)排序
+func backups(t *testing.T, w *Writer) []string {
+	dir, prefix, _ := w.parts()
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// 压缩和清理在后台执行，等待条件满足
+func waitFor(t *testing.T, what string, ok func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for ", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func write(t *testing.T, w *Writer, s string) {
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	// 切割后的文件名精确到毫秒
+	time.Sleep(2 * time.Millisecond)
+}
+
+func TestRotateBySize(t *testing.T) {
+	w := &Writer{Filename: filepath.Join(t.TempDir(), "app.log"), MaxSize: 10}
+	defer w.Close()
+
+	write(t, w, "line-1\n")
+	write(t, w, "line-2\n")
+	write(t, w, "line-3\n")
+
+	files := backups(t, w)
+	if len(files) != 2 {
+		t.Fatalf("got %d backups, want 2: %v", len(files), files)
+	}
+	if got := readFile(t, files[0]); got != "line-1\n" {
+		t.Fatalf("first backup: %q", got)
+	}
+	if got := readFile(t, files[1]); got != "line-2\n" {
+		t.Fatalf("second backup: %q", got)
+	}
+	if got := readFile(t, w.Filename); got != "line-3\n" {
+		t.Fatalf("current file: %q", got)
+	}
+}
+
+func TestRotateByInterval(t *testing.T) {
+	w := &Writer{Filename: filepath.Join(t.TempDir(), "app.log"), Interval: 20 * time.Millisecond}
+	defer w.Close()
+
+	write(t, w, "a\n")
+	write(t, w, "b\n")
+	if files := backups(t, w); len(files) != 0 {
+		t.Fatalf("rotated before the interval: %v", files)
+	}
+	time.Sleep(30 * time.Millisecond)
+	write(t, w, "c\n")
+
+	files := backups(t, w)
+	if len(files) != 1 || readFile(t, files[0]) != "a\nb\n" {
+		t.Fatalf("unexpected backups: %v", files)
+	}
+	if got := readFile(t, w.Filename); got != "c\n" {
+		t.Fatalf("current file: %q", got)
+	}
+}
+
+func TestCleanupMaxBackups(t *testing.T) {
+	w := &Writer{Filename: filepath.Join(t.TempDir(), "app.log"), MaxBackups: 2}
+	defer w.Close()
+
+	for _, s := range []string{"1", "2", "3", "4"} {
+		write(t, w, s)
+		if err := w.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "old backups to be removed", func() bool {
+		return len(backups(t, w)) == 2
+	})
+	files := backups(t, w)
+	if readFile(t, files[0]) != "3" || readFile(t, files[1]) != "4" {
+		t.Fatalf("kept the wrong backups: %v", files)
+	}
+}
+
+func TestCleanupMaxAge(t *testing.T) {
+	w := &Writer{Filename: filepath.Join(t.TempDir(), "app.log"), MaxAge: time.Hour}
+	defer w.Close()
+
+	old := w.backupName(time.Now().Add(-2 * time.Hour))
+	if err := ioutil.WriteFile(old, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 不是切割产生的文件不删除
+	other := filepath.Join(filepath.Dir(w.Filename), "app-other.log")
+	if err := ioutil.WriteFile(other, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, w, "new")
+	if err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "expired backup to be removed", func() bool {
+		_, err := os.Stat(old)
+		return os.IsNotExist(err)
+	})
+	if _, err := os.Stat(other); err != nil {
+		t.Fatal("unrelated file was removed: ", err)
+	}
+	if files := backups(t, w); len(files) != 2 {
+		t.Fatalf("got %v, want the new backup and the unrelated file", files)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	w := &Writer{Filename: filepath.Join(t.TempDir(), "app.log"), Compress: true}
+	defer w.Close()
+
+	write(t, w, "compressed")
+	if err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "backup to be compressed", func() bool {
+		files := backups(t, w)
+		return len(files) == 1 && filepath.Ext(files[0]) == compressSuffix
+	})
+
+	f, err := os.Open(backups(t, w)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "compressed" {
+		t.Fatalf("decompressed %q", b)
+	}
+}
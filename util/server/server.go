@@ -0,0 +1,21 @@
+package server
+
+import (
+	"kappagent/util/tool"
+	"net/http"
+)
+
+var mux = http.NewServeMux()
+
+// 注册http接口，需要在Start之前调用
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// 启动agent的http服务(metrics等)
+func Start(addr string) {
+	tool.Log.WithField("addr", addr).Info("http服务启动")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		tool.Log.WithError(err).Error("http服务启动失败")
+	}
+}
@@ -0,0 +1,246 @@
+package sink
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"kappagent/util/metrics"
+	"kappagent/util/tool"
+	"sync"
+	"time"
+)
+
+const (
+	envBatchMaxSize  = "BATCH_MAX_SIZE"
+	envBatchMaxBytes = "BATCH_MAX_BYTES"
+	envBatchMaxWait  = "BATCH_MAX_WAIT"
+)
+
+type BatchOptions struct {
+	// 每批最多的事件数，小于等于1时不合并
+	MaxSize int
+	// 每批数据的最大字节数
+	MaxBytes int
+	// 第一个事件最多等待的时间
+	MaxWait time.Duration
+}
+
+func BatchOptionsFromEnv() BatchOptions {
+	return BatchOptions{
+		MaxSize:  tool.EnvInt(envBatchMaxSize, 1),
+		MaxBytes: tool.EnvInt(envBatchMaxBytes, 1024*1024),
+		MaxWait:  tool.EnvDuration(envBatchMaxWait, time.Second),
+	}
+}
+
+// 把同一集群的事件合并成一个请求发送，注册和全量同步数据直接发送。
+// 事件放入批次后Send就返回，发送失败只记录日志和指标
+func NewBatchSink(s Sink, opt BatchOptions) Sink {
+	b := &BatchSink{
+		sink:     s,
+		opt:      opt,
+		batches:  make(map[string]*batch),
+		outboxes: make(map[string]*outbox),
+	}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+type BatchSink struct {
+	sink    Sink
+	opt     BatchOptions
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	batches map[string]*batch
+	// 集群已经凑好、等待发送的数据
+	outboxes map[string]*outbox
+}
+
+// 一个集群待发送的事件
+type batch struct {
+	cluster  string
+	cloud    string
+	messages []*Message
+	size     int
+	timer    *time.Timer
+}
+
+// 按顺序发送的数据，同一时间每个集群只有一个协程在发送
+type outbox struct {
+	items   []*outboxItem
+	sending bool
+}
+
+type outboxItem struct {
+	msg *Message
+	// 批次中的事件，发送失败时记录指标
+	events []*Message
+	// 需要等待发送结果时不为nil
+	done chan error
+}
+
+func (b *BatchSink) Name() string {
+	return b.sink.Name()
+}
+
+// 事件放入批次后就返回
+func (b *BatchSink) Deferred() bool {
+	return true
+}
+
+func (b *BatchSink) Send(msg *Message) error {
+	b.mutex.Lock()
+	if msg.Kind != KindEvent {
+		// 先发送之前的事件，保证顺序
+		b.flush(msg.Cluster)
+		done := make(chan error, 1)
+		b.enqueue(msg.Cluster, &outboxItem{msg: msg, done: done})
+		b.mutex.Unlock()
+		b.drain(msg.Cluster)
+		ctx := msg.context()
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	bt := b.batches[msg.Cluster]
+	if bt != nil && bt.size+len(msg.Data)+1 > b.opt.MaxBytes {
+		b.flush(msg.Cluster)
+		bt = nil
+	}
+	if bt == nil {
+		bt = &batch{cluster: msg.Cluster, cloud: msg.Cloud}
+		b.batches[msg.Cluster] = bt
+		bt.timer = time.AfterFunc(b.opt.MaxWait, func() {
+			b.mutex.Lock()
+			// 批次已经因为数量或大小发送过了
+			if b.batches[bt.cluster] == bt {
+				b.flush(bt.cluster)
+			}
+			b.mutex.Unlock()
+			b.drain(bt.cluster)
+		})
+	}
+	bt.messages = append(bt.messages, msg)
+	bt.size += len(msg.Data) + 1
+	if len(bt.messages) >= b.opt.MaxSize || bt.size >= b.opt.MaxBytes {
+		b.flush(msg.Cluster)
+	}
+	b.mutex.Unlock()
+	b.drain(msg.Cluster)
+	return nil
+}
+
+// 把集群当前的批次放入待发送列表，需要持有锁
+func (b *BatchSink) flush(cluster string) {
+	bt := b.batches[cluster]
+	if bt == nil {
+		return
+	}
+	delete(b.batches, cluster)
+	bt.timer.Stop()
+
+	msg := bt.messages[0]
+	// 只有一个事件时按原样发送
+	if len(bt.messages) > 1 {
+		msg = bt.message()
+	}
+	metrics.BatchSize.WithLabelValues(b.sink.Name()).Observe(float64(len(bt.messages)))
+	b.enqueue(cluster, &outboxItem{msg: msg, events: bt.messages})
+}
+
+// 需要持有锁
+func (b *BatchSink) enqueue(cluster string, it *outboxItem) {
+	o := b.outboxes[cluster]
+	if o == nil {
+		o = &outbox{}
+		b.outboxes[cluster] = o
+	}
+	o.items = append(o.items, it)
+}
+
+// 不持有锁时调用。没有其他协程在发送该集群的数据时，按顺序发送待发送列表直到为空
+func (b *BatchSink) drain(cluster string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	o := b.outboxes[cluster]
+	if o == nil || o.sending {
+		return
+	}
+	o.sending = true
+	for len(o.items) > 0 {
+		it := o.items[0]
+		o.items = o.items[1:]
+		b.mutex.Unlock()
+		b.deliver(cluster, it)
+		b.mutex.Lock()
+	}
+	delete(b.outboxes, cluster)
+	b.cond.Broadcast()
+}
+
+func (b *BatchSink) deliver(cluster string, it *outboxItem) {
+	// 已经取消的注册和全量同步数据不再发送
+	if it.done != nil && it.msg.context().Err() != nil {
+		it.done <- it.msg.context().Err()
+		return
+	}
+	err := b.sink.Send(it.msg)
+	if it.done != nil {
+		it.done <- err
+		return
+	}
+	if err != nil {
+		tool.Log.WithError(err).WithFields(logrus.Fields{
+			tool.FieldCluster: cluster,
+			"events":          len(it.events),
+		}).Error("批量发送事件失败")
+		for _, m := range it.events {
+			metrics.EventsDropped.WithLabelValues(cluster, m.Resource, string(m.EventType), metrics.DropSendFailed).Inc()
+		}
+	}
+}
+
+func (bt *batch) message() *Message {
+	var data bytes.Buffer
+	data.Grow(bt.size + 1)
+	data.WriteByte('[')
+	for i, m := range bt.messages {
+		if i > 0 {
+			data.WriteByte(',')
+		}
+		data.Write(m.Data)
+	}
+	data.WriteByte(']')
+	return &Message{
+		Kind:    KindBatch,
+		Cluster: bt.cluster,
+		Cloud:   bt.cloud,
+		Data:    data.Bytes(),
+	}
+}
+
+// 发送所有未发送的批次，等待正在发送的数据完成后关闭
+func (b *BatchSink) Close() error {
+	b.mutex.Lock()
+	for cluster := range b.batches {
+		b.flush(cluster)
+	}
+	clusters := make([]string, 0, len(b.outboxes))
+	for cluster := range b.outboxes {
+		clusters = append(clusters, cluster)
+	}
+	b.mutex.Unlock()
+
+	for _, cluster := range clusters {
+		b.drain(cluster)
+	}
+	b.mutex.Lock()
+	for len(b.outboxes) > 0 {
+		b.cond.Wait()
+	}
+	b.mutex.Unlock()
+	return b.sink.Close()
+}
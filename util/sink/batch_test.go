@@ -0,0 +1,121 @@
+package sink
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func event(cluster string, i int) *Message {
+	return &Message{Kind: KindEvent, Cluster: cluster, Cloud: "test", Data: []byte(fmt.Sprint(i))}
+}
+
+func TestBatchFlushOnSize(t *testing.T) {
+	mem := &memorySink{}
+	b := NewBatchSink(mem, BatchOptions{MaxSize: 3, MaxBytes: 1 << 20, MaxWait: time.Hour})
+
+	for i := 1; i <= 7; i++ {
+		if err := b.Send(event("c1", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := mem.received()
+	if want := []string{"[1,2,3]", "[4,5,6]"}; !reflect.DeepEqual(data(got), want) {
+		t.Fatalf("got %v, want %v", data(got), want)
+	}
+	if got[0].Kind != KindBatch || got[0].Cluster != "c1" || got[0].Cloud != "test" {
+		t.Fatalf("unexpected batch message: %+v", got[0])
+	}
+
+	// 关闭时发送剩下的事件，只有一个事件时按原样发送
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got = mem.received()
+	if len(got) != 3 || string(got[2].Data) != "7" || got[2].Kind != KindEvent || !mem.closed {
+		t.Fatalf("close did not flush the last event: %v", data(got))
+	}
+}
+
+func TestBatchFlushOnBytes(t *testing.T) {
+	mem := &memorySink{}
+	b := NewBatchSink(mem, BatchOptions{MaxSize: 100, MaxBytes: 6, MaxWait: time.Hour})
+	defer b.Close()
+
+	// 每个事件算上分隔符占3个字节
+	for _, i := range []int{10, 11, 12, 13, 14} {
+		if err := b.Send(event("c1", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := data(mem.received()), []string{"[10,11]", "[12,13]"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestBatchFlushOnTime(t *testing.T) {
+	mem := &memorySink{}
+	b := NewBatchSink(mem, BatchOptions{MaxSize: 100, MaxBytes: 1 << 20, MaxWait: 20 * time.Millisecond})
+	defer b.Close()
+
+	b.Send(event("c1", 1))
+	b.Send(event("c1", 2))
+	b.Send(event("c2", 3))
+	if got := mem.received(); len(got) != 0 {
+		t.Fatalf("sent before MaxWait: %v", data(got))
+	}
+
+	got := data(mem.wait(t, 2))
+	// 不同集群的批次分别发送，顺序不确定
+	if !reflect.DeepEqual(got, []string{"[1,2]", "3"}) && !reflect.DeepEqual(got, []string{"3", "[1,2]"}) {
+		t.Fatalf("unexpected batches %v", got)
+	}
+}
+
+// 注册和全量同步数据先发送之前的事件，并等待发送完成
+func TestBatchKeepsOrderWithRegister(t *testing.T) {
+	mem := &memorySink{}
+	b := NewBatchSink(mem, BatchOptions{MaxSize: 100, MaxBytes: 1 << 20, MaxWait: time.Hour})
+
+	b.Send(event("c1", 1))
+	b.Send(event("c1", 2))
+	if err := b.Send(&Message{Kind: KindResync, Cluster: "c1", Data: []byte("resync")}); err != nil {
+		t.Fatal(err)
+	}
+	b.Send(event("c1", 3))
+	b.Close()
+
+	if got, want := data(mem.received()), []string{"[1,2]", "resync", "3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// 下游发送慢时，其他集群的事件和同一集群后续的事件不会被阻塞
+func TestBatchDoesNotBlockWhileSending(t *testing.T) {
+	mem := &memorySink{block: make(chan struct{})}
+	b := NewBatchSink(mem, BatchOptions{MaxSize: 2, MaxBytes: 1 << 20, MaxWait: time.Hour})
+
+	// 凑满批次的协程负责发送，阻塞在下游
+	go func() {
+		b.Send(event("c1", 1))
+		b.Send(event("c1", 2))
+	}()
+	mem.wait(t, 1)
+
+	within(t, "send while another batch is being delivered", func() {
+		b.Send(event("c1", 3))
+		b.Send(event("c1", 4))
+		b.Send(event("c2", 5))
+	})
+
+	close(mem.block)
+	within(t, "close", func() { b.Close() })
+	got := data(mem.received())
+	if len(got) != 3 || got[0] != "[1,2]" {
+		t.Fatalf("unexpected batches %v", got)
+	}
+	if !(got[1] == "[3,4]" && got[2] == "5" || got[1] == "5" && got[2] == "[3,4]") {
+		t.Fatalf("unexpected batches %v", got)
+	}
+}
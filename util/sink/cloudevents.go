@@ -0,0 +1,222 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CloudEvents 的传输模式
+const (
+	// 事件属性和数据一起放在消息体里
+	CEStructured = "structured"
+	// 事件属性放在header里，消息体只有数据
+	CEBinary = "binary"
+
+	ceSpecVersion          = "1.0"
+	ceStructuredType       = "application/cloudevents+json"
+	ceDataContentType      = "application/json"
+	ceKafkaTimeout         = 10 * time.Second
+	ceHttpHeaderPrefix     = "ce-"
+	ceKafkaHeaderPrefix    = "ce_"
+	ceKafkaContentTypeName = "content-type"
+)
+
+// CloudEvents 1.0 事件
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	// 扩展属性，数据的幂等key，重复发送或回放的数据相同
+	IdempotencyKey string          `json:"idempotencykey,omitempty"`
+	Data           json.RawMessage `json:"data"`
+}
+
+// 事件id由stream和序号组成，每次发送都不同；没有序号的数据(如批量发送)使用随机id
+func NewCloudEvent(msg *Message) *CloudEvent {
+	id := newEventID()
+	if msg.Stream != "" {
+		id = fmt.Sprintf("%s-%d", msg.Stream, msg.Sequence)
+	}
+	return &CloudEvent{
+		SpecVersion:     ceSpecVersion,
+		ID:              id,
+		Source:          EventSource(msg),
+		Type:            EventType(msg),
+		Time:            time.Now().UTC(),
+		DataContentType: ceDataContentType,
+		IdempotencyKey:  msg.ID,
+		Data:            json.RawMessage(msg.Data),
+	}
+}
+
+// 事件类型，如 kapp.deployment.modified、kapp.cluster.registered
+func EventType(msg *Message) string {
+	switch msg.Kind {
+	case KindRegister:
+		return "kapp.cluster.registered"
+	case KindResync:
+		return "kapp.cluster.resynced"
+	case KindBatch:
+		return "kapp.batch"
+	}
+	return "kapp." + strings.ToLower(msg.Resource) + "." + strings.ToLower(string(msg.EventType))
+}
+
+// 事件来源，如 /kapp/qcloud/prod-a
+func EventSource(msg *Message) string {
+	return "/kapp/" + url.PathEscape(msg.Cloud) + "/" + url.PathEscape(msg.Cluster)
+}
+
+// binary 模式下的事件属性
+func (e *CloudEvent) attributes() map[string]string {
+	attrs := map[string]string{
+		"specversion": e.SpecVersion,
+		"id":          e.ID,
+		"source":      e.Source,
+		"type":        e.Type,
+		"time":        e.Time.Format(time.RFC3339Nano),
+	}
+	if e.IdempotencyKey != "" {
+		attrs["idempotencykey"] = e.IdempotencyKey
+	}
+	return attrs
+}
+
+// 随机生成的 UUID v4
+func newEventID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// 以CloudEvents HTTP协议发送
+type CloudEventsHttpSink struct {
+	siteUrl string
+	mode    string
+	client  *http.Client
+}
+
+func NewCloudEventsHttpSink(siteUrl, mode string, client *http.Client) (*CloudEventsHttpSink, error) {
+	if mode != CEStructured && mode != CEBinary {
+		return nil, fmt.Errorf("不支持的CloudEvents模式: %s", mode)
+	}
+	return &CloudEventsHttpSink{siteUrl: siteUrl, mode: mode, client: client}, nil
+}
+
+func (c *CloudEventsHttpSink) Name() string {
+	return "cloudevents-http"
+}
+
+func (c *CloudEventsHttpSink) Send(msg *Message) error {
+	event := NewCloudEvent(msg)
+	var req *http.Request
+	var err error
+	if c.mode == CEStructured {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if req, err = http.NewRequest(http.MethodPost, c.siteUrl, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", ceStructuredType)
+	} else {
+		if req, err = http.NewRequest(http.MethodPost, c.siteUrl, bytes.NewReader(msg.Data)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", event.DataContentType)
+		for k, v := range event.attributes() {
+			req.Header.Set(ceHttpHeaderPrefix+k, v)
+		}
+	}
+
+	resp, err := c.client.Do(req.WithContext(msg.context()))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// 读完body后连接才能复用
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("发送失败: %d %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (c *CloudEventsHttpSink) Close() error {
+	return nil
+}
+
+// 以CloudEvents Kafka协议发送，同一个集群的数据发送到同一个分区
+type KafkaSink struct {
+	writer *kafka.Writer
+	mode   string
+}
+
+func NewKafkaSink(brokers []string, topic, mode string) (*KafkaSink, error) {
+	if mode != CEStructured && mode != CEBinary {
+		return nil, fmt.Errorf("不支持的CloudEvents模式: %s", mode)
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("没有配置kafka地址")
+	}
+	return &KafkaSink{
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  brokers,
+			Topic:    topic,
+			Balancer: &kafka.Hash{},
+		}),
+		mode: mode,
+	}, nil
+}
+
+func (k *KafkaSink) Name() string {
+	return "kafka"
+}
+
+func (k *KafkaSink) Send(msg *Message) error {
+	event := NewCloudEvent(msg)
+	m := kafka.Message{Key: []byte(msg.Cluster)}
+	if k.mode == CEStructured {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		m.Value = value
+		m.Headers = []kafka.Header{{Key: ceKafkaContentTypeName, Value: []byte(ceStructuredType)}}
+	} else {
+		m.Value = msg.Data
+		m.Headers = []kafka.Header{{Key: ceKafkaContentTypeName, Value: []byte(event.DataContentType)}}
+		for key, v := range event.attributes() {
+			m.Headers = append(m.Headers, kafka.Header{Key: ceKafkaHeaderPrefix + key, Value: []byte(v)})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(msg.context(), ceKafkaTimeout)
+	defer cancel()
+	return k.writer.WriteMessages(ctx, m)
+}
+
+func (k *KafkaSink) Close() error {
+	return k.writer.Close()
+}
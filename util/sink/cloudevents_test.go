@@ -0,0 +1,30 @@
+package sink
+
+import "testing"
+
+func TestCloudEventID(t *testing.T) {
+	msg := &Message{Kind: KindEvent, Cluster: "c1", ID: "c1/Node/u1/7/MODIFIED", Stream: "s1", Sequence: 3, Data: []byte("{}")}
+	e := NewCloudEvent(msg)
+	if e.ID != "s1-3" {
+		t.Fatalf("id = %q, want stream and sequence", e.ID)
+	}
+	if e.IdempotencyKey != msg.ID || e.attributes()["idempotencykey"] != msg.ID {
+		t.Fatalf("idempotency key should be an extension attribute: %+v", e)
+	}
+
+	// 重发的数据幂等key相同，id不同
+	msg.Sequence = 4
+	if again := NewCloudEvent(msg); again.ID == e.ID || again.IdempotencyKey != e.IdempotencyKey {
+		t.Fatalf("re-sent payload: id %q, key %q", again.ID, again.IdempotencyKey)
+	}
+
+	// 没有序号的数据使用随机id
+	batch := &Message{Kind: KindBatch, Cluster: "c1", Data: []byte("[]")}
+	a, b := NewCloudEvent(batch), NewCloudEvent(batch)
+	if a.ID == "" || a.ID == b.ID {
+		t.Fatalf("batch ids %q and %q should be random", a.ID, b.ID)
+	}
+	if _, ok := a.attributes()["idempotencykey"]; ok {
+		t.Fatal("empty idempotency key should be omitted")
+	}
+}
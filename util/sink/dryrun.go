@@ -0,0 +1,67 @@
+package sink
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"kappagent/util/metrics"
+	"kappagent/util/tool"
+	"time"
+)
+
+// dry-run 的记录方式
+const (
+	DryRunLog   = "log"
+	DryRunFile  = "file"
+	DryRunCount = "count"
+)
+
+// 只记录数据不发送，用于和线上版本对比输出
+type DryRunSink struct {
+	mode string
+	file *FileSink
+}
+
+// mode 为 log、file 或 count，file 模式下把数据写入 filename(jsonl)
+func NewDryRunSink(mode, filename string) (*DryRunSink, error) {
+	d := &DryRunSink{mode: mode}
+	switch mode {
+	case DryRunLog, DryRunCount:
+	case DryRunFile:
+		d.file = NewFileSink(FileOptions{Filename: filename, FsyncInterval: time.Second})
+	default:
+		return nil, fmt.Errorf("不支持的dry-run模式: %s", mode)
+	}
+	return d, nil
+}
+
+func (d *DryRunSink) Name() string {
+	return "dryrun"
+}
+
+func (d *DryRunSink) Send(msg *Message) error {
+	metrics.DryRunPayloads.WithLabelValues(msg.Cluster, msg.Kind).Inc()
+	metrics.DryRunBytes.WithLabelValues(msg.Cluster, msg.Kind).Add(float64(len(msg.Data)))
+
+	switch d.mode {
+	case DryRunLog:
+		r := NewRecord(msg, false)
+		tool.Log.WithFields(logrus.Fields{
+			tool.FieldCluster:  r.Cluster,
+			tool.FieldResource: r.Resource,
+			tool.FieldEvent:    r.EventType,
+			"kind":             r.Kind,
+			"size":             r.Size,
+			"hash":             r.Hash,
+		}).Info("dry-run")
+	case DryRunFile:
+		return d.file.Send(msg)
+	}
+	return nil
+}
+
+func (d *DryRunSink) Close() error {
+	if d.file != nil {
+		return d.file.Close()
+	}
+	return nil
+}
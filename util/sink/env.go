@@ -0,0 +1,98 @@
+package sink
+
+import (
+	"kappagent/util/tool"
+	"strings"
+)
+
+const (
+	envSink       = "SINK"
+	envSinkFile   = "SINK_FILE"
+	envDryRun     = "DRY_RUN"
+	envDryRunFile = "DRY_RUN_FILE"
+	// 设置后http sink以CloudEvents格式发送
+	envCloudEvents  = "CLOUDEVENTS"
+	envKafkaBrokers = "KAFKA_BROKERS"
+	envKafkaTopic   = "KAFKA_TOPIC"
+)
+
+// 根据环境变量创建sink，设置了DRY_RUN时不会发送到siteUrl
+func NewFromEnv(siteUrl string) (Sink, error) {
+	s, err := newFromEnv(siteUrl)
+	if err != nil {
+		return nil, err
+	}
+	if opt := LimitOptionsFromEnv(); opt.enabled() {
+		s = NewLimitSink(s, opt)
+	}
+	if opt := QueueOptionsFromEnv(); opt.Size > 0 {
+		if s, err = NewQueueSink(s, opt); err != nil {
+			return nil, err
+		}
+	}
+	if opt := BatchOptionsFromEnv(); opt.MaxSize > 1 {
+		return NewBatchSink(s, opt), nil
+	}
+	return s, nil
+}
+
+func newFromEnv(siteUrl string) (Sink, error) {
+	if mode := tool.EnvString(envDryRun, ""); mode != "" {
+		tool.Log.WithField("mode", mode).Warn("dry-run模式，数据不会上报")
+		return New(mode, tool.EnvString(envDryRunFile, "./dryrun.jsonl"))
+	}
+	switch name := tool.EnvString(envSink, "http"); name {
+	case "file":
+		return New(name, tool.EnvString(envSinkFile, "./data/kapp.jsonl"))
+	case "kafka":
+		return New(name, tool.EnvString(envKafkaBrokers, ""))
+	case "grpc":
+		return New(name, tool.EnvString(envGrpcTarget, ""))
+	}
+	return New("http", siteUrl)
+}
+
+// 按名称创建sink：http 的target为上报地址，file 的target为文件路径，
+// kafka 的target为逗号分隔的broker地址，grpc 的target为grpc地址，其他名称作为dry-run模式(log、count)
+func New(name, target string) (Sink, error) {
+	switch name {
+	case "http":
+		client, err := NewHttpClient(HttpClientOptionsFromEnv())
+		if err != nil {
+			return nil, err
+		}
+		if mode := tool.EnvString(envCloudEvents, ""); mode != "" {
+			c, err := NewCloudEventsHttpSink(target, mode, client)
+			if err != nil {
+				return nil, err
+			}
+			return Instrument(c), nil
+		}
+		return Instrument(NewHttpSink(target, client)), nil
+	case "kafka":
+		var brokers []string
+		for _, b := range strings.Split(target, ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				brokers = append(brokers, b)
+			}
+		}
+		k, err := NewKafkaSink(brokers, tool.EnvString(envKafkaTopic, "kapp"), tool.EnvString(envCloudEvents, CEBinary))
+		if err != nil {
+			return nil, err
+		}
+		return Instrument(k), nil
+	case "grpc":
+		g, err := NewGrpcSink(GrpcOptionsFromEnv(target))
+		if err != nil {
+			return nil, err
+		}
+		return Instrument(g), nil
+	case "file":
+		return Instrument(NewFileSink(FileOptionsFromEnv(target))), nil
+	}
+	d, err := NewDryRunSink(name, target)
+	if err != nil {
+		return nil, err
+	}
+	return Instrument(d), nil
+}
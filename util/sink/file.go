@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"encoding/json"
+	"kappagent/util/rotate"
+	"kappagent/util/tool"
+	"time"
+)
+
+const (
+	envSinkFileMaxSize    = "SINK_FILE_MAX_SIZE"
+	envSinkFileInterval   = "SINK_FILE_ROTATE_INTERVAL"
+	envSinkFileMaxAge     = "SINK_FILE_MAX_AGE"
+	envSinkFileMaxBackups = "SINK_FILE_MAX_BACKUPS"
+	envSinkFileCompress   = "SINK_FILE_COMPRESS"
+	envSinkFileFsync      = "SINK_FILE_FSYNC_INTERVAL"
+)
+
+type FileOptions struct {
+	Filename   string
+	MaxSize    int64
+	Interval   time.Duration
+	MaxAge     time.Duration
+	MaxBackups int
+	Compress   bool
+	// 刷盘间隔，0表示每次写入后刷盘
+	FsyncInterval time.Duration
+}
+
+// 从环境变量读取切割和刷盘配置
+func FileOptionsFromEnv(filename string) FileOptions {
+	return FileOptions{
+		Filename:      filename,
+		MaxSize:       int64(tool.EnvInt(envSinkFileMaxSize, 100)) * 1024 * 1024,
+		Interval:      tool.EnvDuration(envSinkFileInterval, 0),
+		MaxAge:        tool.EnvDuration(envSinkFileMaxAge, 0),
+		MaxBackups:    tool.EnvInt(envSinkFileMaxBackups, 0),
+		Compress:      tool.EnvBool(envSinkFileCompress, false),
+		FsyncInterval: tool.EnvDuration(envSinkFileFsync, time.Second),
+	}
+}
+
+// 把数据以jsonl格式追加写入本地文件，用于离线环境，文件可以用replay命令重新发送
+type FileSink struct {
+	writer        *rotate.Writer
+	fsyncInterval time.Duration
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+func NewFileSink(opt FileOptions) *FileSink {
+	f := &FileSink{
+		writer: &rotate.Writer{
+			Filename:   opt.Filename,
+			MaxSize:    opt.MaxSize,
+			Interval:   opt.Interval,
+			MaxAge:     opt.MaxAge,
+			MaxBackups: opt.MaxBackups,
+			Compress:   opt.Compress,
+		},
+		fsyncInterval: opt.FsyncInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if f.fsyncInterval > 0 {
+		go f.startFsync()
+	} else {
+		close(f.done)
+	}
+	return f
+}
+
+func (f *FileSink) Name() string {
+	return "file"
+}
+
+func (f *FileSink) Send(msg *Message) error {
+	line, err := json.Marshal(NewRecord(msg, true))
+	if err != nil {
+		return err
+	}
+	if _, err := f.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if f.fsyncInterval <= 0 {
+		return f.writer.Sync()
+	}
+	return nil
+}
+
+func (f *FileSink) Close() error {
+	select {
+	case <-f.stop:
+		return nil
+	default:
+		close(f.stop)
+	}
+	<-f.done
+	if err := f.writer.Sync(); err != nil {
+		tool.Log.WithError(err).Warn("文件刷盘失败")
+	}
+	return f.writer.Close()
+}
+
+// 定时刷盘
+func (f *FileSink) startFsync() {
+	defer close(f.done)
+	ticker := time.NewTicker(f.fsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.writer.Sync(); err != nil {
+				tool.Log.WithError(err).Warn("文件刷盘失败")
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"io/ioutil"
+	"kappagent/util/backoff"
+	"kappagent/util/metrics"
+	"kappagent/util/sink/grpcapi"
+	"kappagent/util/tool"
+	"sync"
+	"time"
+)
+
+const (
+	envGrpcTarget     = "GRPC_TARGET"
+	envGrpcWindow     = "GRPC_WINDOW"
+	envGrpcAckTimeout = "GRPC_ACK_TIMEOUT"
+	envGrpcTLS        = "GRPC_TLS"
+	envGrpcCAFile     = "GRPC_CA_FILE"
+	envGrpcServerName = "GRPC_TLS_SERVER_NAME"
+)
+
+var (
+	errGrpcClosed     = errors.New("grpc sink已关闭")
+	errGrpcAckTimeout = errors.New("等待grpc确认超时")
+)
+
+type GrpcOptions struct {
+	// grpc地址，如 host:port、dns:///host:port
+	Target string
+	// 最多允许多少条数据未确认，达到后发送等待
+	Window int
+	// 注册和全量同步等待确认的时间，以及关闭时等待未确认数据的时间
+	AckTimeout time.Duration
+	TLS        bool
+	// 额外信任的CA证书(PEM)，设置后开启TLS
+	CAFile string
+	// 校验证书时使用的域名，设置后开启TLS
+	ServerName string
+	// 额外的连接选项，如测试时连接进程内的服务
+	DialOptions []grpc.DialOption
+}
+
+func GrpcOptionsFromEnv(target string) GrpcOptions {
+	return GrpcOptions{
+		Target:     target,
+		Window:     tool.EnvInt(envGrpcWindow, 100),
+		AckTimeout: tool.EnvDuration(envGrpcAckTimeout, 30*time.Second),
+		TLS:        tool.EnvBool(envGrpcTLS, false),
+		CAFile:     tool.EnvString(envGrpcCAFile, ""),
+		ServerName: tool.EnvString(envGrpcServerName, ""),
+	}
+}
+
+// 通过一个双向stream发送数据，每条数据带递增的序号，接收端按序号确认。
+// 断线重连后按顺序重发所有未确认的数据，接收端按 (stream, sequence) 去重。
+// 注册和全量同步等到确认后才返回，事件发送到stream后即返回
+type GrpcSink struct {
+	opt    GrpcOptions
+	conn   *grpc.ClientConn
+	stream string
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// 保证数据按序号顺序写入stream，重连后重发时也持有
+	sendMutex sync.Mutex
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	seq     uint64
+	pending []*grpcPending
+	current grpcapi.Sink_DeliverClient
+	closed  bool
+}
+
+type grpcPending struct {
+	env *grpcapi.Envelope
+	// 需要等待确认时不为nil
+	result chan error
+}
+
+func NewGrpcSink(opt GrpcOptions) (*GrpcSink, error) {
+	if opt.Target == "" {
+		return nil, errors.New("没有设置grpc地址")
+	}
+	if opt.Window < 1 {
+		opt.Window = 1
+	}
+	creds, err := grpcCredentials(opt)
+	if err != nil {
+		return nil, err
+	}
+	dialOptions := append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, opt.DialOptions...)
+	conn, err := grpc.NewClient(opt.Target, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GrpcSink{
+		opt:    opt,
+		conn:   conn,
+		stream: newEventID(),
+	}
+	g.cond = sync.NewCond(&g.mutex)
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	g.wg.Add(1)
+	go g.run()
+	return g, nil
+}
+
+func grpcCredentials(opt GrpcOptions) (credentials.TransportCredentials, error) {
+	if !opt.TLS && opt.CAFile == "" && opt.ServerName == "" {
+		return insecure.NewCredentials(), nil
+	}
+	tlsConfig := &tls.Config{ServerName: opt.ServerName}
+	if opt.CAFile != "" {
+		pem, err := ioutil.ReadFile(opt.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("CA文件中没有可用的证书: " + opt.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+func (g *GrpcSink) Name() string {
+	return "grpc"
+}
+
+func (g *GrpcSink) Send(msg *Message) error {
+	p := &grpcPending{env: &grpcapi.Envelope{
+		Stream:    g.stream,
+		Kind:      msg.Kind,
+		Cluster:   msg.Cluster,
+		Cloud:     msg.Cloud,
+		Resource:  msg.Resource,
+		EventType: string(msg.EventType),
+		Id:        msg.ID,
+		Data:      msg.Data,
+	}}
+	if msg.Kind != KindEvent && msg.Kind != KindBatch {
+		p.result = make(chan error, 1)
+	}
+	ctx := msg.context()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := g.acquire(); err != nil {
+		return err
+	}
+	g.seq++
+	p.env.Sequence = g.seq
+	g.pending = append(g.pending, p)
+	metrics.SinkUnacked.WithLabelValues(g.Name()).Set(float64(len(g.pending)))
+	stream := g.current
+	g.mutex.Unlock()
+	if stream != nil {
+		// 失败时由接收ack的goroutine发现断线，重连后重发
+		if err := stream.Send(p.env); err != nil {
+			tool.Log.WithField("seq", p.env.Sequence).Debug("grpc发送失败，等待重连: ", err)
+		}
+	}
+	g.sendMutex.Unlock()
+
+	if p.result == nil {
+		return nil
+	}
+	timer := time.NewTimer(g.opt.AckTimeout)
+	defer timer.Stop()
+	// 超时或取消时数据仍保留在未确认列表中，之后还会重发
+	select {
+	case err := <-p.result:
+		return err
+	case <-timer.C:
+		return errGrpcAckTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 等待未确认数据少于窗口，返回时持有 sendMutex 和 mutex
+func (g *GrpcSink) acquire() error {
+	for {
+		g.mutex.Lock()
+		for !g.closed && len(g.pending) >= g.opt.Window {
+			g.cond.Wait()
+		}
+		g.mutex.Unlock()
+
+		g.sendMutex.Lock()
+		g.mutex.Lock()
+		if g.closed {
+			g.mutex.Unlock()
+			g.sendMutex.Unlock()
+			return errGrpcClosed
+		}
+		if len(g.pending) < g.opt.Window {
+			return nil
+		}
+		g.mutex.Unlock()
+		g.sendMutex.Unlock()
+	}
+}
+
+// 断线后按退避时间重连，直到关闭
+func (g *GrpcSink) run() {
+	defer g.wg.Done()
+	b := backoff.NewBackoff(time.Second, 30*time.Second)
+	attempt := 0
+	reconnect := false
+	for {
+		connected, err := g.connect(reconnect)
+		reconnect = reconnect || connected
+		if g.ctx.Err() != nil {
+			return
+		}
+		if connected {
+			attempt = 0
+		}
+		attempt++
+		tool.Log.WithField("target", g.opt.Target).Warn("grpc stream断开，准备重连: ", err)
+
+		timer := time.NewTimer(b.Duration(attempt))
+		select {
+		case <-g.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// 建立stream并按顺序发送未确认的数据(包括还没有连接时的)，然后接收确认直到stream断开
+func (g *GrpcSink) connect(reconnect bool) (bool, error) {
+	stream, err := grpcapi.NewSinkClient(g.conn).Deliver(g.ctx)
+	if err != nil {
+		return false, err
+	}
+
+	g.sendMutex.Lock()
+	g.mutex.Lock()
+	resend := append([]*grpcPending(nil), g.pending...)
+	g.current = stream
+	g.mutex.Unlock()
+	for _, p := range resend {
+		if err := stream.Send(p.env); err != nil {
+			break
+		}
+	}
+	g.sendMutex.Unlock()
+	if reconnect {
+		metrics.SinkReconnects.WithLabelValues(g.Name()).Inc()
+		if len(resend) > 0 {
+			tool.Log.WithField("count", len(resend)).Info("grpc重发未确认的数据")
+			metrics.SinkResent.WithLabelValues(g.Name()).Add(float64(len(resend)))
+		}
+	}
+
+	for {
+		ack, err := stream.Recv()
+		if err != nil {
+			g.mutex.Lock()
+			if g.current == stream {
+				g.current = nil
+			}
+			g.mutex.Unlock()
+			return true, err
+		}
+		g.ack(ack)
+	}
+}
+
+func (g *GrpcSink) ack(ack *grpcapi.Ack) {
+	g.mutex.Lock()
+	var p *grpcPending
+	for i := range g.pending {
+		if g.pending[i].env.Sequence == ack.Sequence {
+			p = g.pending[i]
+			g.pending = append(g.pending[:i], g.pending[i+1:]...)
+			break
+		}
+	}
+	metrics.SinkUnacked.WithLabelValues(g.Name()).Set(float64(len(g.pending)))
+	g.cond.Broadcast()
+	g.mutex.Unlock()
+	// 重发后收到的重复确认
+	if p == nil {
+		return
+	}
+
+	var err error
+	if ack.Error != "" {
+		err = errors.New("grpc接收端拒绝: " + ack.Error)
+	}
+	if p.result != nil {
+		p.result <- err
+		return
+	}
+	if err != nil {
+		// 事件已经返回给调用方，只能记录下来
+		tool.Log.WithField("cluster", p.env.Cluster).WithField("seq", p.env.Sequence).Error(err)
+		resource, event := metrics.SendLabels(p.env.Resource, p.env.EventType)
+		metrics.SendFailures.WithLabelValues(g.Name(), p.env.Kind, resource, event).Inc()
+	}
+}
+
+// 最多等待 AckTimeout 让未确认的数据收到确认，然后关闭连接
+func (g *GrpcSink) Close() error {
+	g.mutex.Lock()
+	if g.closed {
+		g.mutex.Unlock()
+		return nil
+	}
+	g.closed = true
+	g.cond.Broadcast()
+	timer := time.AfterFunc(g.opt.AckTimeout, func() {
+		g.mutex.Lock()
+		g.cond.Broadcast()
+		g.mutex.Unlock()
+	})
+	deadline := time.Now().Add(g.opt.AckTimeout)
+	for len(g.pending) > 0 && time.Now().Before(deadline) {
+		g.cond.Wait()
+	}
+	timer.Stop()
+	if len(g.pending) > 0 {
+		tool.Log.WithField("count", len(g.pending)).Warn("grpc sink关闭时仍有数据未确认")
+	}
+	g.mutex.Unlock()
+
+	g.cancel()
+	g.wg.Wait()
+	return g.conn.Close()
+}
@@ -0,0 +1,112 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"kappagent/util/sink/grpcapi"
+	"kappagent/util/sink/grpcapi/grpcapitest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type grpcReceived struct {
+	mutex sync.Mutex
+	envs  []*grpcapi.Envelope
+}
+
+func (r *grpcReceived) handle(env *grpcapi.Envelope) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.envs = append(r.envs, env)
+	if string(env.Data) == "reject" {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func (r *grpcReceived) list() []*grpcapi.Envelope {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*grpcapi.Envelope(nil), r.envs...)
+}
+
+func newTestGrpcSink(t *testing.T, window int) (*GrpcSink, *grpcapitest.Server, *grpcReceived) {
+	received := &grpcReceived{}
+	server := grpcapitest.NewServer(received.handle)
+	dialer := server.StartInProcess()
+	t.Cleanup(server.Stop)
+
+	g, err := NewGrpcSink(GrpcOptions{
+		Target:      grpcapitest.InProcessTarget,
+		Window:      window,
+		AckTimeout:  10 * time.Second,
+		DialOptions: []grpc.DialOption{dialer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, server, received
+}
+
+func TestGrpcSinkAck(t *testing.T) {
+	g, _, received := newTestGrpcSink(t, 10)
+	defer g.Close()
+
+	if err := g.Send(&Message{Kind: KindRegister, Cluster: "c1", ID: "r1", Data: []byte("ok")}); err != nil {
+		t.Fatal("register should be acked: ", err)
+	}
+	err := g.Send(&Message{Kind: KindResync, Cluster: "c1", Data: []byte("reject")})
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatal("rejected resync should fail, got: ", err)
+	}
+
+	envs := received.list()
+	if len(envs) != 2 {
+		t.Fatalf("received %d payloads, want 2", len(envs))
+	}
+	first := envs[0]
+	if first.Sequence != 1 || first.Kind != KindRegister || first.Cluster != "c1" || first.Id != "r1" {
+		t.Fatalf("unexpected envelope: %v", first)
+	}
+	if envs[1].Sequence != 2 || envs[1].Stream != first.Stream {
+		t.Fatalf("second payload should continue the stream: %v", envs[1])
+	}
+}
+
+// 断线后重发未确认的数据，接收端按顺序收到每条数据正好一次
+func TestGrpcSinkResendAfterDrop(t *testing.T) {
+	g, server, received := newTestGrpcSink(t, 50)
+
+	const total = 201
+	for i := 1; i <= total; i++ {
+		msg := &Message{Kind: KindEvent, Cluster: "c1", Data: []byte(fmt.Sprint(i))}
+		if i == total {
+			msg.Kind = KindResync
+		}
+		if i%40 == 0 {
+			server.DropConnections()
+		}
+		if err := g.Send(msg); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	envs := received.list()
+	if len(envs) != total {
+		t.Fatalf("received %d payloads, want %d", len(envs), total)
+	}
+	for i, env := range envs {
+		if env.Sequence != uint64(i+1) || string(env.Data) != fmt.Sprint(i+1) {
+			t.Fatalf("payload %d out of order: sequence %d data %s", i+1, env.Sequence, env.Data)
+		}
+	}
+	if got, _ := server.Stats(); got < total {
+		t.Fatalf("server counted %d payloads, want at least %d", got, total)
+	}
+}
@@ -0,0 +1,156 @@
+package grpcapitest
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"kappagent/util/sink/grpcapi"
+	"net"
+	"sync"
+)
+
+// 进程内服务使用的target，配合 StartInProcess 返回的DialOption
+const InProcessTarget = "passthrough:///in-process"
+
+// 参考实现的接收端，只在测试中使用，agent的代码不要引用这个包。
+// 每个stream只处理比已处理序号大的数据，重发的数据直接确认，不再交给handler
+type Server struct {
+	grpcapi.UnimplementedSinkServer
+
+	handler func(env *grpcapi.Envelope) error
+
+	mutex sync.Mutex
+	// stream -> 已处理的最大序号
+	acked      map[string]uint64
+	received   int
+	duplicates int
+
+	connMutex sync.Mutex
+	conns     map[net.Conn]bool
+	server    *grpc.Server
+}
+
+// handler 返回的错误作为确认中的error，handler 为nil时只确认
+func NewServer(handler func(env *grpcapi.Envelope) error) *Server {
+	return &Server{
+		handler: handler,
+		acked:   make(map[string]uint64),
+		conns:   make(map[net.Conn]bool),
+	}
+}
+
+func (s *Server) Deliver(stream grpcapi.Sink_DeliverServer) error {
+	for {
+		env, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ack := &grpcapi.Ack{Sequence: env.Sequence}
+		if err := s.handle(env); err != nil {
+			ack.Error = err.Error()
+		}
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// 加锁处理，同一个stream断开重连时新旧连接的数据也不会乱序
+func (s *Server) handle(env *grpcapi.Envelope) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.received++
+	if env.Sequence <= s.acked[env.Stream] {
+		s.duplicates++
+		return nil
+	}
+	s.acked[env.Stream] = env.Sequence
+	if s.handler == nil {
+		return nil
+	}
+	return s.handler(env)
+}
+
+// 收到的数据条数(包括重发的)和其中重复的条数
+func (s *Server) Stats() (received, duplicates int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.received, s.duplicates
+}
+
+// 在lis上提供服务，直到 Stop
+func (s *Server) Serve(lis net.Listener) error {
+	s.connMutex.Lock()
+	if s.server == nil {
+		s.server = grpc.NewServer(grpc.MaxRecvMsgSize(64 << 20))
+		grpcapi.RegisterSinkServer(s.server, s)
+	}
+	server := s.server
+	s.connMutex.Unlock()
+	return server.Serve(&trackListener{Listener: lis, server: s})
+}
+
+// 在进程内启动，客户端使用 InProcessTarget 和返回的DialOption连接
+func (s *Server) StartInProcess() grpc.DialOption {
+	lis := bufconn.Listen(1 << 20)
+	go s.Serve(lis)
+	return grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+}
+
+// 断开所有已建立的连接，服务继续运行，用来测试客户端重连
+func (s *Server) DropConnections() {
+	s.connMutex.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.connMutex.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (s *Server) Stop() {
+	s.connMutex.Lock()
+	server := s.server
+	s.connMutex.Unlock()
+	if server != nil {
+		server.Stop()
+	}
+}
+
+// 记录接受的连接
+type trackListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *trackListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c = &trackConn{Conn: c, server: l.server}
+	l.server.connMutex.Lock()
+	l.server.conns[c] = true
+	l.server.connMutex.Unlock()
+	return c, nil
+}
+
+type trackConn struct {
+	net.Conn
+	server *Server
+}
+
+func (c *trackConn) Close() error {
+	c.server.connMutex.Lock()
+	delete(c.server.conns, c)
+	c.server.connMutex.Unlock()
+	return c.Conn.Close()
+}
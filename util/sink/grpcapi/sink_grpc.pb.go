@@ -0,0 +1,124 @@
+// Service implemented by receivers of kapp-agent with SINK=grpc.
+// util/sink/grpcapi is generated from this file by script/proto.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: schema/sink.proto
+
+package grpcapi
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Sink_Deliver_FullMethodName = "/kapp.sink.v1.Sink/Deliver"
+)
+
+// SinkClient is the client API for Sink service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SinkClient interface {
+	// The agent opens one stream and sends payloads in order; the receiver answers every
+	// Envelope with an Ack. After a reconnect the agent resends every payload that was not
+	// acked, so receivers should deduplicate by (stream, sequence) or by id.
+	Deliver(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Envelope, Ack], error)
+}
+
+type sinkClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSinkClient(cc grpc.ClientConnInterface) SinkClient {
+	return &sinkClient{cc}
+}
+
+func (c *sinkClient) Deliver(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Envelope, Ack], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Sink_ServiceDesc.Streams[0], Sink_Deliver_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Envelope, Ack]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Sink_DeliverClient = grpc.BidiStreamingClient[Envelope, Ack]
+
+// SinkServer is the server API for Sink service.
+// All implementations must embed UnimplementedSinkServer
+// for forward compatibility.
+type SinkServer interface {
+	// The agent opens one stream and sends payloads in order; the receiver answers every
+	// Envelope with an Ack. After a reconnect the agent resends every payload that was not
+	// acked, so receivers should deduplicate by (stream, sequence) or by id.
+	Deliver(grpc.BidiStreamingServer[Envelope, Ack]) error
+	mustEmbedUnimplementedSinkServer()
+}
+
+// UnimplementedSinkServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSinkServer struct{}
+
+func (UnimplementedSinkServer) Deliver(grpc.BidiStreamingServer[Envelope, Ack]) error {
+	return status.Errorf(codes.Unimplemented, "method Deliver not implemented")
+}
+func (UnimplementedSinkServer) mustEmbedUnimplementedSinkServer() {}
+func (UnimplementedSinkServer) testEmbeddedByValue()              {}
+
+// UnsafeSinkServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SinkServer will
+// result in compilation errors.
+type UnsafeSinkServer interface {
+	mustEmbedUnimplementedSinkServer()
+}
+
+func RegisterSinkServer(s grpc.ServiceRegistrar, srv SinkServer) {
+	// If the following call pancis, it indicates UnimplementedSinkServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Sink_ServiceDesc, srv)
+}
+
+func _Sink_Deliver_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(SinkServer).Deliver(&grpc.GenericServerStream[Envelope, Ack]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Sink_DeliverServer = grpc.BidiStreamingServer[Envelope, Ack]
+
+// Sink_ServiceDesc is the grpc.ServiceDesc for Sink service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Sink_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kapp.sink.v1.Sink",
+	HandlerType: (*SinkServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Deliver",
+			Handler:       _Sink_Deliver_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "schema/sink.proto",
+}
@@ -0,0 +1,40 @@
+package sink
+
+import (
+	"errors"
+	"kappagent/util/tool"
+	"net/http"
+)
+
+var errHttpFailed = errors.New("http发送失败")
+
+// 以表单方式POST到上报地址
+type HttpSink struct {
+	siteUrl string
+	client  *http.Client
+}
+
+func NewHttpSink(siteUrl string, client *http.Client) *HttpSink {
+	return &HttpSink{siteUrl: siteUrl, client: client}
+}
+
+func (h *HttpSink) Name() string {
+	return "http"
+}
+
+func (h *HttpSink) Send(msg *Message) error {
+	var success bool
+	if msg.Kind == KindEvent || msg.Kind == KindBatch {
+		success = tool.HttpPostForm(msg.context(), h.client, string(msg.Data), h.siteUrl, msg.EventType)
+	} else {
+		success = tool.RegCluster(msg.context(), h.client, string(msg.Data), h.siteUrl)
+	}
+	if !success {
+		return errHttpFailed
+	}
+	return nil
+}
+
+func (h *HttpSink) Close() error {
+	return nil
+}
@@ -0,0 +1,121 @@
+package sink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"kappagent/util/tool"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	envHttpConnectTimeout   = "SINK_HTTP_CONNECT_TIMEOUT"
+	envHttpResponseTimeout  = "SINK_HTTP_RESPONSE_TIMEOUT"
+	envHttpTimeout          = "SINK_HTTP_TIMEOUT"
+	envHttpKeepAlive        = "SINK_HTTP_KEEPALIVE"
+	envHttpIdleTimeout      = "SINK_HTTP_IDLE_CONN_TIMEOUT"
+	envHttpMaxIdlePerHost   = "SINK_HTTP_MAX_IDLE_CONNS_PER_HOST"
+	envHttpDisableKeepAlive = "SINK_HTTP_DISABLE_KEEPALIVES"
+	envHttpProxy            = "SINK_HTTP_PROXY"
+	envHttpCAFile           = "SINK_HTTP_CA_FILE"
+	envHttpServerName       = "SINK_HTTP_TLS_SERVER_NAME"
+
+	// 不使用代理
+	ProxyDirect = "direct"
+)
+
+// 上报使用的http客户端配置
+type HttpClientOptions struct {
+	// 建立连接和TLS握手的超时时间
+	ConnectTimeout time.Duration
+	// 发送请求后等待响应头的超时时间
+	ResponseTimeout time.Duration
+	// 整个请求的超时时间，0表示不限制
+	Timeout time.Duration
+	// TCP keep-alive 间隔
+	KeepAlive time.Duration
+	// 空闲连接保留的时间
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+	// 每个请求使用新的连接
+	DisableKeepAlives bool
+	// 代理地址，为空时使用 HTTP_PROXY、HTTPS_PROXY、NO_PROXY 环境变量，direct 表示不使用代理
+	Proxy string
+	// 额外信任的CA证书(PEM)
+	CAFile string
+	// 校验证书时使用的域名，为空时使用上报地址中的域名
+	ServerName string
+}
+
+func HttpClientOptionsFromEnv() HttpClientOptions {
+	return HttpClientOptions{
+		ConnectTimeout:      tool.EnvDuration(envHttpConnectTimeout, 10*time.Second),
+		ResponseTimeout:     tool.EnvDuration(envHttpResponseTimeout, 30*time.Second),
+		Timeout:             tool.EnvDuration(envHttpTimeout, time.Minute),
+		KeepAlive:           tool.EnvDuration(envHttpKeepAlive, 30*time.Second),
+		IdleConnTimeout:     tool.EnvDuration(envHttpIdleTimeout, 90*time.Second),
+		MaxIdleConnsPerHost: tool.EnvInt(envHttpMaxIdlePerHost, 10),
+		DisableKeepAlives:   tool.EnvBool(envHttpDisableKeepAlive, false),
+		Proxy:               tool.EnvString(envHttpProxy, ""),
+		CAFile:              tool.EnvString(envHttpCAFile, ""),
+		ServerName:          tool.EnvString(envHttpServerName, ""),
+	}
+}
+
+func NewHttpClient(opt HttpClientOptions) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   opt.ConnectTimeout,
+		KeepAlive: opt.KeepAlive,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opt.ConnectTimeout,
+		ResponseHeaderTimeout: opt.ResponseTimeout,
+		IdleConnTimeout:       opt.IdleConnTimeout,
+		MaxIdleConnsPerHost:   opt.MaxIdleConnsPerHost,
+		DisableKeepAlives:     opt.DisableKeepAlives,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	switch opt.Proxy {
+	case "":
+	case ProxyDirect:
+		transport.Proxy = nil
+	default:
+		proxy, err := url.Parse(opt.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if opt.CAFile != "" || opt.ServerName != "" {
+		tlsConfig := &tls.Config{ServerName: opt.ServerName}
+		if opt.CAFile != "" {
+			pem, err := ioutil.ReadFile(opt.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			// 在系统CA的基础上增加
+			pool, err := x509.SystemCertPool()
+			if err != nil || pool == nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("CA文件中没有可用的证书: " + opt.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   opt.Timeout,
+	}, nil
+}
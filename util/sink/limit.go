@@ -0,0 +1,88 @@
+package sink
+
+import (
+	"golang.org/x/time/rate"
+	"kappagent/util/metrics"
+	"kappagent/util/tool"
+	"time"
+)
+
+const (
+	envSinkRate        = "SINK_RATE"
+	envSinkBurst       = "SINK_BURST"
+	envSinkConcurrency = "SINK_CONCURRENCY"
+)
+
+type LimitOptions struct {
+	// 每秒最多发送的请求数，0表示不限制
+	Rate  float64
+	Burst int
+	// 同时进行的最多请求数，0表示不限制
+	Concurrency int
+}
+
+func LimitOptionsFromEnv() LimitOptions {
+	return LimitOptions{
+		Rate:        tool.EnvFloat(envSinkRate, 0),
+		Burst:       tool.EnvInt(envSinkBurst, 1),
+		Concurrency: tool.EnvInt(envSinkConcurrency, 0),
+	}
+}
+
+func (o LimitOptions) enabled() bool {
+	return o.Rate > 0 || o.Concurrency > 0
+}
+
+// 限制发送速率和并发数，多个集群共用sink时一起计算
+func NewLimitSink(s Sink, opt LimitOptions) Sink {
+	l := &LimitSink{sink: s}
+	if opt.Rate > 0 {
+		burst := opt.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		l.limiter = rate.NewLimiter(rate.Limit(opt.Rate), burst)
+	}
+	if opt.Concurrency > 0 {
+		l.slots = make(chan struct{}, opt.Concurrency)
+	}
+	return l
+}
+
+type LimitSink struct {
+	sink    Sink
+	limiter *rate.Limiter
+	slots   chan struct{}
+}
+
+func (l *LimitSink) Name() string {
+	return l.sink.Name()
+}
+
+func (l *LimitSink) Send(msg *Message) error {
+	ctx := msg.context()
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() {
+			<-l.slots
+		}()
+	}
+	if l.limiter != nil {
+		start := time.Now()
+		if err := l.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		metrics.SinkRateLimitedSeconds.WithLabelValues(l.Name()).Add(time.Since(start).Seconds())
+	}
+	metrics.SinkInflight.WithLabelValues(l.Name()).Inc()
+	defer metrics.SinkInflight.WithLabelValues(l.Name()).Dec()
+	return l.sink.Send(msg)
+}
+
+func (l *LimitSink) Close() error {
+	return l.sink.Close()
+}
@@ -0,0 +1,396 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"kappagent/util/metrics"
+	"kappagent/util/tool"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	envSinkQueueSize    = "SINK_QUEUE_SIZE"
+	envSinkBackpressure = "SINK_BACKPRESSURE"
+	envSinkSpillDir     = "SINK_SPILL_DIR"
+)
+
+// 发送队列满时的处理策略
+const (
+	// 等待队列有空间
+	PolicyBlock = "block"
+	// 丢弃队列中最早的事件
+	PolicyDropOldest = "drop_oldest"
+	// 写入磁盘，队列空了以后按顺序读回发送
+	PolicySpill = "spill"
+)
+
+var errQueueClosed = errors.New("发送队列已关闭")
+
+type QueueOptions struct {
+	// 每个集群内存中最多排队的数据条数，0表示不排队，直接发送
+	Size   int
+	Policy string
+	// spill 策略下写入的目录，每个集群一个文件
+	SpillDir string
+}
+
+func QueueOptionsFromEnv() QueueOptions {
+	return QueueOptions{
+		Size:     tool.EnvInt(envSinkQueueSize, 0),
+		Policy:   tool.EnvString(envSinkBackpressure, PolicyBlock),
+		SpillDir: tool.EnvString(envSinkSpillDir, "./data/spill"),
+	}
+}
+
+// 每个集群一个发送队列，由单独的协程按顺序发送，发送慢时不会阻塞watch。
+// 事件放入队列后Send就返回；注册和全量同步数据等待发送结果，并且不会被丢弃或写入磁盘
+func NewQueueSink(s Sink, opt QueueOptions) (Sink, error) {
+	switch opt.Policy {
+	case PolicyBlock, PolicyDropOldest:
+	case PolicySpill:
+		if err := os.MkdirAll(opt.SpillDir, 0755); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("不支持的队列策略: " + opt.Policy)
+	}
+	return &QueueSink{
+		sink:   s,
+		opt:    opt,
+		queues: make(map[string]*queue),
+	}, nil
+}
+
+type QueueSink struct {
+	sink   Sink
+	opt    QueueOptions
+	mutex  sync.Mutex
+	queues map[string]*queue
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type queue struct {
+	sink    *QueueSink
+	cluster string
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	items   []*item
+	// 磁盘上有还没发送的数据
+	spilled bool
+	closed  bool
+}
+
+type item struct {
+	msg *Message
+	// 需要等待发送结果时不为空
+	done chan error
+}
+
+func (q *QueueSink) Name() string {
+	return q.sink.Name()
+}
+
+// 事件放入队列后就返回
+func (q *QueueSink) Deferred() bool {
+	return true
+}
+
+func (q *QueueSink) Send(msg *Message) error {
+	qu, err := q.queue(msg.Cluster)
+	if err != nil {
+		return err
+	}
+	if msg.Kind == KindEvent || msg.Kind == KindBatch {
+		return qu.push(msg)
+	}
+	done := make(chan error, 1)
+	if err := qu.pushWait(&item{msg: msg, done: done}); err != nil {
+		return err
+	}
+	// 取消后数据留在队列中，轮到时不再发送
+	ctx := msg.context()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *QueueSink) queue(cluster string) (*queue, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return nil, errQueueClosed
+	}
+	qu := q.queues[cluster]
+	if qu == nil {
+		qu = &queue{sink: q, cluster: cluster}
+		qu.cond = sync.NewCond(&qu.mutex)
+		// 上次退出时没有发送完的数据
+		if q.opt.Policy == PolicySpill {
+			qu.spilled = exists(qu.spillFile()) || exists(qu.drainFile())
+		}
+		q.queues[cluster] = qu
+		q.wg.Add(1)
+		go qu.run()
+	}
+	return qu, nil
+}
+
+// 关闭时发送完内存中的数据，磁盘上的数据留到下次启动
+func (q *QueueSink) Close() error {
+	q.mutex.Lock()
+	q.closed = true
+	for _, qu := range q.queues {
+		qu.mutex.Lock()
+		qu.closed = true
+		qu.cond.Broadcast()
+		qu.mutex.Unlock()
+	}
+	q.mutex.Unlock()
+	q.wg.Wait()
+	return q.sink.Close()
+}
+
+// 按策略放入事件
+func (qu *queue) push(msg *Message) error {
+	qu.mutex.Lock()
+	defer qu.mutex.Unlock()
+	if qu.closed {
+		return errQueueClosed
+	}
+	opt := qu.sink.opt
+	switch opt.Policy {
+	case PolicySpill:
+		// 已经有数据在磁盘上时也写入磁盘，保证顺序
+		if qu.spilled || len(qu.items) >= opt.Size {
+			if err := qu.spill(msg); err != nil {
+				return err
+			}
+			qu.spilled = true
+			metrics.SinkSpilled.WithLabelValues(qu.sink.Name(), qu.cluster).Inc()
+			qu.cond.Broadcast()
+			return nil
+		}
+	case PolicyDropOldest:
+		if len(qu.items) >= opt.Size && qu.dropOldest() {
+			break
+		}
+		fallthrough
+	default:
+		qu.wait(func() bool { return len(qu.items) < opt.Size })
+		if qu.closed {
+			return errQueueClosed
+		}
+	}
+	qu.append(&item{msg: msg})
+	return nil
+}
+
+// 等待队列有空间并且磁盘上没有数据后放入
+func (qu *queue) pushWait(it *item) error {
+	ctx := it.msg.context()
+	// 取消时唤醒等待
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			qu.mutex.Lock()
+			qu.cond.Broadcast()
+			qu.mutex.Unlock()
+		case <-stop:
+		}
+	}()
+
+	qu.mutex.Lock()
+	defer qu.mutex.Unlock()
+	qu.wait(func() bool {
+		return len(qu.items) < qu.sink.opt.Size && !qu.spilled || ctx.Err() != nil
+	})
+	if qu.closed {
+		return errQueueClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	qu.append(it)
+	return nil
+}
+
+// 需要持有锁
+func (qu *queue) wait(ready func() bool) {
+	if ready() || qu.closed {
+		return
+	}
+	start := time.Now()
+	for !ready() && !qu.closed {
+		qu.cond.Wait()
+	}
+	metrics.SinkBlockedSeconds.WithLabelValues(qu.sink.Name(), qu.cluster).Add(time.Since(start).Seconds())
+}
+
+func (qu *queue) append(it *item) {
+	qu.items = append(qu.items, it)
+	metrics.SinkQueueDepth.WithLabelValues(qu.sink.Name(), qu.cluster).Set(float64(len(qu.items)))
+	qu.cond.Broadcast()
+}
+
+// 丢弃最早的事件，队列中只有等待结果的数据时返回false
+func (qu *queue) dropOldest() bool {
+	for i, it := range qu.items {
+		if it.done != nil {
+			continue
+		}
+		qu.items = append(qu.items[:i], qu.items[i+1:]...)
+		metrics.SinkDropped.WithLabelValues(qu.sink.Name(), qu.cluster).Inc()
+		if it.msg.Kind == KindEvent {
+			metrics.EventsDropped.WithLabelValues(qu.cluster, it.msg.Resource, string(it.msg.EventType), metrics.DropQueueFull).Inc()
+		}
+		return true
+	}
+	return false
+}
+
+func (qu *queue) run() {
+	defer qu.sink.wg.Done()
+	for {
+		qu.mutex.Lock()
+		for len(qu.items) == 0 && !qu.spilled && !qu.closed {
+			qu.cond.Wait()
+		}
+		if len(qu.items) > 0 {
+			it := qu.items[0]
+			qu.items = qu.items[1:]
+			metrics.SinkQueueDepth.WithLabelValues(qu.sink.Name(), qu.cluster).Set(float64(len(qu.items)))
+			qu.cond.Broadcast()
+			qu.mutex.Unlock()
+			qu.send(it)
+			continue
+		}
+		if qu.closed {
+			qu.mutex.Unlock()
+			return
+		}
+		// 内存中的数据发送完了，读回磁盘上的数据。
+		// 读回期间新的数据先放入内存，比文件中的数据晚发送
+		qu.spilled = false
+		qu.cond.Broadcast()
+		if !exists(qu.drainFile()) && exists(qu.spillFile()) {
+			if err := os.Rename(qu.spillFile(), qu.drainFile()); err != nil {
+				tool.Log.WithError(err).WithField(tool.FieldCluster, qu.cluster).Error("读取spill文件失败")
+				qu.mutex.Unlock()
+				time.Sleep(time.Second)
+				qu.mutex.Lock()
+			}
+		}
+		qu.mutex.Unlock()
+
+		qu.unspill()
+
+		qu.mutex.Lock()
+		if exists(qu.spillFile()) || exists(qu.drainFile()) {
+			qu.spilled = true
+		}
+		qu.cond.Broadcast()
+		qu.mutex.Unlock()
+	}
+}
+
+func (qu *queue) send(it *item) {
+	if err := it.msg.context().Err(); err != nil {
+		if it.done != nil {
+			it.done <- err
+		}
+		return
+	}
+	err := qu.sink.sink.Send(it.msg)
+	if it.done != nil {
+		it.done <- err
+		return
+	}
+	if err != nil {
+		tool.Log.WithError(err).WithField(tool.FieldCluster, qu.cluster).Error("发送队列中的数据失败")
+		if it.msg.Kind == KindEvent {
+			metrics.EventsDropped.WithLabelValues(qu.cluster, it.msg.Resource, string(it.msg.EventType), metrics.DropSendFailed).Inc()
+		}
+	}
+}
+
+func (qu *queue) spillFile() string {
+	return filepath.Join(qu.sink.opt.SpillDir, url.PathEscape(qu.cluster)+".jsonl")
+}
+
+// 正在读回的文件，进程在读回时退出的话下次启动先发送这个文件
+func (qu *queue) drainFile() string {
+	return qu.spillFile() + ".draining"
+}
+
+// 需要持有锁
+func (qu *queue) spill(msg *Message) error {
+	f, err := os.OpenFile(qu.spillFile(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(NewRecord(msg, true))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 按顺序发送读回文件中的数据，发送完后删除文件
+func (qu *queue) unspill() {
+	log := tool.Log.WithField(tool.FieldCluster, qu.cluster)
+	f, err := os.Open(qu.drainFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Error("读取spill文件失败")
+		}
+		return
+	}
+	decoder := json.NewDecoder(f)
+	for {
+		// 关闭时保留文件，下次启动重新发送，接收方通过幂等key去重
+		if qu.isClosed() {
+			f.Close()
+			return
+		}
+		var r Record
+		if err := decoder.Decode(&r); err != nil {
+			if err != io.EOF {
+				log.WithError(err).Error("spill文件格式错误，跳过剩余的数据")
+			}
+			break
+		}
+		qu.send(&item{msg: r.Message()})
+		metrics.SinkUnspilled.WithLabelValues(qu.sink.Name(), qu.cluster).Inc()
+	}
+	f.Close()
+	if err := os.Remove(qu.drainFile()); err != nil {
+		log.WithError(err).Error("删除spill文件失败")
+	}
+}
+
+func (qu *queue) isClosed() bool {
+	qu.mutex.Lock()
+	defer qu.mutex.Unlock()
+	return qu.closed
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
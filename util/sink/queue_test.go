@@ -0,0 +1,170 @@
+package sink
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, mem *memorySink, opt QueueOptions) *QueueSink {
+	s, err := NewQueueSink(mem, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*QueueSink)
+}
+
+// 集群队列内存中的数据条数
+func (q *QueueSink) testLen(cluster string) int {
+	qu, _ := q.queue(cluster)
+	qu.mutex.Lock()
+	defer qu.mutex.Unlock()
+	return len(qu.items)
+}
+
+func waitUntil(t *testing.T, what string, ok func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for ", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func sequence(from, to int) []string {
+	var out []string
+	for i := from; i <= to; i++ {
+		out = append(out, fmt.Sprint(i))
+	}
+	return out
+}
+
+func TestQueueBlock(t *testing.T) {
+	mem := &memorySink{block: make(chan struct{})}
+	q := newTestQueue(t, mem, QueueOptions{Size: 1, Policy: PolicyBlock})
+
+	q.Send(event("c1", 1))
+	mem.wait(t, 1)
+	q.Send(event("c1", 2))
+
+	pushed := make(chan struct{})
+	go func() {
+		q.Send(event("c1", 3))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("send should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(mem.block)
+	within(t, "blocked send", func() { <-pushed })
+	within(t, "close", func() { q.Close() })
+	if got, want := data(mem.received()), sequence(1, 3); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// 丢弃最早的事件，等待结果的数据不会被丢弃
+func TestQueueDropOldest(t *testing.T) {
+	mem := &memorySink{block: make(chan struct{})}
+	q := newTestQueue(t, mem, QueueOptions{Size: 2, Policy: PolicyDropOldest})
+
+	q.Send(event("c1", 1))
+	mem.wait(t, 1)
+	registered := make(chan error, 1)
+	go func() {
+		registered <- q.Send(&Message{Kind: KindRegister, Cluster: "c1", Data: []byte(`"register"`)})
+	}()
+	waitUntil(t, "register to be queued", func() bool { return q.testLen("c1") == 1 })
+	q.Send(event("c1", 2))
+	q.Send(event("c1", 3))
+	q.Send(event("c1", 4))
+
+	close(mem.block)
+	within(t, "register", func() {
+		if err := <-registered; err != nil {
+			t.Error(err)
+		}
+	})
+	q.Close()
+	if got, want := data(mem.received()), []string{"1", `"register"`, "4"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// 内存满后写入磁盘，之后的数据(包括全量同步)排在磁盘上的数据后面
+func TestQueueSpillOrder(t *testing.T) {
+	mem := &memorySink{block: make(chan struct{})}
+	q := newTestQueue(t, mem, QueueOptions{Size: 2, Policy: PolicySpill, SpillDir: t.TempDir()})
+
+	q.Send(event("c1", 1))
+	mem.wait(t, 1)
+	for i := 2; i <= 10; i++ {
+		if err := q.Send(event("c1", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	qu, _ := q.queue("c1")
+	if !exists(qu.spillFile()) {
+		t.Fatal("events beyond the queue size should be spilled")
+	}
+
+	resynced := make(chan error, 1)
+	go func() {
+		resynced <- q.Send(&Message{Kind: KindResync, Cluster: "c1", Data: []byte(`"resync"`)})
+	}()
+	close(mem.block)
+	within(t, "resync", func() {
+		if err := <-resynced; err != nil {
+			t.Error(err)
+		}
+	})
+	q.Send(event("c1", 11))
+	within(t, "close", func() { q.Close() })
+
+	want := append(sequence(1, 10), `"resync"`, "11")
+	if got := data(mem.received()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if exists(qu.spillFile()) || exists(qu.drainFile()) {
+		t.Fatal("spill files should be removed after draining")
+	}
+}
+
+// 关闭时磁盘上的数据保留到下次启动，按原来的顺序在新数据之前发送
+func TestQueueSpillResume(t *testing.T) {
+	dir := t.TempDir()
+	first := &memorySink{block: make(chan struct{})}
+	q := newTestQueue(t, first, QueueOptions{Size: 2, Policy: PolicySpill, SpillDir: dir})
+
+	q.Send(event("c1", 1))
+	first.wait(t, 1)
+	for i := 2; i <= 6; i++ {
+		q.Send(event("c1", i))
+	}
+	qu, _ := q.queue("c1")
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+	waitUntil(t, "queue to be closed", qu.isClosed)
+	close(first.block)
+	within(t, "close", func() { <-closed })
+	if got, want := data(first.received()), sequence(1, 3); !reflect.DeepEqual(got, want) {
+		t.Fatalf("first run sent %v, want %v", got, want)
+	}
+
+	second := &memorySink{}
+	q = newTestQueue(t, second, QueueOptions{Size: 2, Policy: PolicySpill, SpillDir: dir})
+	q.Send(event("c1", 7))
+	second.wait(t, 4)
+	within(t, "close", func() { q.Close() })
+	if got, want := data(second.received()), sequence(4, 7); !reflect.DeepEqual(got, want) {
+		t.Fatalf("second run sent %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,61 @@
+package sink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"k8s.io/apimachinery/pkg/watch"
+	"time"
+)
+
+// 写入文件的一条数据，每行一个json
+type Record struct {
+	Time      time.Time       `json:"time"`
+	Kind      string          `json:"kind"`
+	Cluster   string          `json:"cluster"`
+	Cloud     string          `json:"cloud,omitempty"`
+	Resource  string          `json:"resource,omitempty"`
+	EventType watch.EventType `json:"event,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Stream    string          `json:"stream,omitempty"`
+	Sequence  uint64          `json:"sequence,omitempty"`
+	Size      int             `json:"size"`
+	Hash      string          `json:"hash"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// withPayload 为false时只记录大小和hash
+func NewRecord(msg *Message, withPayload bool) *Record {
+	sum := sha256.Sum256(msg.Data)
+	r := &Record{
+		Time:      time.Now(),
+		Kind:      msg.Kind,
+		Cluster:   msg.Cluster,
+		Cloud:     msg.Cloud,
+		Resource:  msg.Resource,
+		EventType: msg.EventType,
+		ID:        msg.ID,
+		Stream:    msg.Stream,
+		Sequence:  msg.Sequence,
+		Size:      len(msg.Data),
+		Hash:      hex.EncodeToString(sum[:]),
+	}
+	if withPayload {
+		r.Payload = json.RawMessage(msg.Data)
+	}
+	return r
+}
+
+func (r *Record) Message() *Message {
+	return &Message{
+		Kind:      r.Kind,
+		Cluster:   r.Cluster,
+		Cloud:     r.Cloud,
+		Resource:  r.Resource,
+		EventType: r.EventType,
+		ID:        r.ID,
+		Stream:    r.Stream,
+		Sequence:  r.Sequence,
+		Data:      []byte(r.Payload),
+	}
+}
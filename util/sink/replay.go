@@ -0,0 +1,119 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"io"
+	"kappagent/util/tool"
+	"time"
+)
+
+// 重放参数
+type ReplayOptions struct {
+	// 只重放该时间范围内的数据，零值表示不限制
+	Since time.Time
+	Until time.Time
+	// 每秒最多发送条数，0表示不限速
+	Rate float64
+	// 不为空时替换数据中的集群名称
+	ClusterName string
+}
+
+// 重放结果
+type ReplayResult struct {
+	Read    int `json:"read"`
+	Skipped int `json:"skipped"`
+	Sent    int `json:"sent"`
+	Failed  int `json:"failed"`
+}
+
+// 读取记录的jsonl数据，重新发送到sink
+func Replay(r io.Reader, s Sink, opt ReplayOptions) (ReplayResult, error) {
+	var result ReplayResult
+	var limiter *rate.Limiter
+	if opt.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opt.Rate), 1)
+	}
+
+	decoder := json.NewDecoder(r)
+	for {
+		var record Record
+		if err := decoder.Decode(&record); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return result, fmt.Errorf("第%d条记录解析失败: %v", result.Read+1, err)
+		}
+		result.Read++
+
+		if !opt.Since.IsZero() && record.Time.Before(opt.Since) ||
+			!opt.Until.IsZero() && record.Time.After(opt.Until) ||
+			len(record.Payload) == 0 {
+			result.Skipped++
+			continue
+		}
+
+		msg := record.Message()
+		// 重放是一次新的发送，CloudEvents id 重新生成，幂等key不变
+		msg.Stream, msg.Sequence = "", 0
+		if opt.ClusterName != "" {
+			data, err := renameCluster(msg.Data, opt.ClusterName)
+			if err != nil {
+				tool.Log.WithError(err).WithField("record", result.Read).Error("替换集群名称失败，没有重放")
+				result.Failed++
+				continue
+			}
+			msg.Cluster = opt.ClusterName
+			msg.Data = data
+		}
+
+		if limiter != nil {
+			if err := limiter.Wait(context.Background()); err != nil {
+				return result, err
+			}
+		}
+		if err := s.Send(msg); err != nil {
+			tool.Log.WithError(err).WithFields(logrus.Fields{
+				"record":           result.Read,
+				tool.FieldResource: msg.Resource,
+				tool.FieldEvent:    msg.EventType,
+			}).Error("重放失败")
+			result.Failed++
+			continue
+		}
+		result.Sent++
+	}
+}
+
+// 替换数据中的 clusterName 字段，批量发送的数据替换数组中的每一条
+func renameCluster(data []byte, clusterName string) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+		for i := range items {
+			renamed, err := renameCluster(items[i], clusterName)
+			if err != nil {
+				return nil, fmt.Errorf("第%d条数据: %v", i+1, err)
+			}
+			items[i] = renamed
+		}
+		return json.Marshal(items)
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	name, err := json.Marshal(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	payload["clusterName"] = name
+	return json.Marshal(payload)
+}
@@ -0,0 +1,51 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func records(t *testing.T, msgs ...*Message) *bytes.Buffer {
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		line, err := json.Marshal(NewRecord(m, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	return &buf
+}
+
+// 批量数据中的每个事件都替换集群名称，无法解析的数据算作失败
+func TestReplayRenameCluster(t *testing.T) {
+	in := records(t,
+		&Message{Kind: KindEvent, Cluster: "old", Data: []byte(`{"clusterName":"old","name":"a"}`)},
+		&Message{Kind: KindBatch, Cluster: "old", Data: []byte(`[{"clusterName":"old","name":"b"},{"clusterName":"old","name":"c"}]`)},
+		&Message{Kind: KindEvent, Cluster: "old", Data: []byte(`"not an object"`)},
+	)
+	mem := &memorySink{}
+	result, err := Replay(in, mem, ReplayOptions{ClusterName: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ReplayResult{Read: 3, Sent: 2, Failed: 1}); result != want {
+		t.Fatalf("got %+v, want %+v", result, want)
+	}
+
+	got := mem.received()
+	want := []string{
+		`{"clusterName":"new","name":"a"}`,
+		`[{"clusterName":"new","name":"b"},{"clusterName":"new","name":"c"}]`,
+	}
+	if !reflect.DeepEqual(data(got), want) {
+		t.Fatalf("got %v, want %v", data(got), want)
+	}
+	for _, m := range got {
+		if m.Cluster != "new" {
+			t.Fatalf("message cluster %q was not renamed", m.Cluster)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"context"
+	"k8s.io/apimachinery/pkg/watch"
+	"kappagent/util/metrics"
+	"time"
+)
+
+// 数据类型
+const (
+	KindRegister = "register"
+	KindResync   = "resync"
+	KindEvent    = "event"
+	// 多个事件合并发送，Data为事件数据组成的json数组
+	KindBatch = "batch"
+)
+
+// 上报的一条数据
+type Message struct {
+	Kind      string
+	Cluster   string
+	Cloud     string
+	Resource  string
+	EventType watch.EventType
+	// 幂等key，可以为空
+	ID string
+	// 数据的stream和序号，每次发送都不同，可以为空
+	Stream   string
+	Sequence uint64
+	// json序列化后的数据
+	Data []byte
+	// 取消后不再发送并且不再等待结果，为nil时不限制。注册超时后用来取消这次请求
+	Context context.Context
+}
+
+func (m *Message) context() context.Context {
+	if m.Context == nil {
+		return context.Background()
+	}
+	return m.Context
+}
+
+// 数据上报的目的地，多个集群可以共用同一个sink
+type Sink interface {
+	Name() string
+	Send(msg *Message) error
+	Close() error
+}
+
+// Send 返回nil时数据可能还没有送达的sink，如批量发送和发送队列
+type deferred interface {
+	Deferred() bool
+}
+
+// 事件是否在送达之前就返回，这时调用方不能根据Send的结果判断接收方已经收到数据
+func Deferred(s Sink) bool {
+	d, ok := s.(deferred)
+	return ok && d.Deferred()
+}
+
+// 给sink加上发送耗时和失败次数的指标
+func Instrument(s Sink) Sink {
+	return &instrumented{Sink: s}
+}
+
+type instrumented struct {
+	Sink
+}
+
+func (i *instrumented) Send(msg *Message) error {
+	start := time.Now()
+	err := i.Sink.Send(msg)
+	resource, event := metrics.SendLabels(msg.Resource, string(msg.EventType))
+	metrics.SendDuration.WithLabelValues(i.Name(), msg.Kind, resource, event).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.SendFailures.WithLabelValues(i.Name(), msg.Kind, resource, event).Inc()
+	}
+	if msg.Kind == KindRegister {
+		if err != nil {
+			metrics.Registrations.WithLabelValues("failure").Inc()
+		} else {
+			metrics.Registrations.WithLabelValues("success").Inc()
+		}
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package sink
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/watch"
+	"kappagent/util/metrics"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录收到的数据，block 不为nil时每次发送都等到 block 关闭
+type memorySink struct {
+	mutex    sync.Mutex
+	messages []*Message
+	block    chan struct{}
+	closed   bool
+}
+
+func (m *memorySink) Name() string {
+	return "memory"
+}
+
+func (m *memorySink) Send(msg *Message) error {
+	m.mutex.Lock()
+	m.messages = append(m.messages, msg)
+	block := m.block
+	m.mutex.Unlock()
+	if block != nil {
+		<-block
+	}
+	return nil
+}
+
+func (m *memorySink) Close() error {
+	m.mutex.Lock()
+	m.closed = true
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *memorySink) received() []*Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]*Message(nil), m.messages...)
+}
+
+// 等待收到至少n条数据
+func (m *memorySink) wait(t *testing.T, n int) []*Message {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := m.received()
+		if len(got) >= n {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d messages, want %d", len(got), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 在限定时间内完成，否则测试失败
+func within(t *testing.T, what string, f func()) {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out: ", what)
+	}
+}
+
+func data(msgs []*Message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = string(m.Data)
+	}
+	return out
+}
+
+type failingSink struct{}
+
+func (failingSink) Name() string            { return "failing" }
+func (failingSink) Send(msg *Message) error { return errors.New("unavailable") }
+func (failingSink) Close() error            { return nil }
+
+// 发送指标按资源和事件类型区分，未知的取值不会产生新的标签
+func TestInstrumentLabels(t *testing.T) {
+	s := Instrument(failingSink{})
+	s.Send(&Message{Kind: KindEvent, Resource: "Deployment", EventType: watch.Modified})
+	s.Send(&Message{Kind: KindEvent, Resource: "ConfigMap", EventType: watch.Modified})
+	s.Send(&Message{Kind: KindBatch})
+
+	for _, c := range []struct {
+		kind, resource, event string
+	}{
+		{KindEvent, "Deployment", "MODIFIED"},
+		{KindEvent, "other", "MODIFIED"},
+		{KindBatch, "", ""},
+	} {
+		if n := testutil.ToFloat64(metrics.SendFailures.WithLabelValues("failing", c.kind, c.resource, c.event)); n != 1 {
+			t.Errorf("%v: %v failures, want 1", c, n)
+		}
+	}
+}
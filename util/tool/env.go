@@ -0,0 +1,93 @@
+package tool
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 读取字符串环境变量，未设置时返回默认值
+func EnvString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// 读取整型环境变量，未设置或格式错误时返回默认值
+func EnvInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		envWarnf("环境变量 %s=%s 不是合法整数，使用默认值 %d", name, v, def)
+		return def
+	}
+	return i
+}
+
+// 读取浮点数环境变量，未设置或格式错误时返回默认值
+func EnvFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		envWarnf("环境变量 %s=%s 不是合法数字，使用默认值 %g", name, v, def)
+		return def
+	}
+	return f
+}
+
+// 读取时长环境变量(如 30s、5m)，未设置或格式错误时返回默认值
+func EnvDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		envWarnf("环境变量 %s=%s 不是合法时长，使用默认值 %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// 读取布尔环境变量，未设置或格式错误时返回默认值
+func EnvBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		envWarnf("环境变量 %s=%s 不是合法布尔值，使用默认值 %t", name, v, def)
+		return def
+	}
+	return b
+}
+
+// 读取逗号分隔的列表环境变量，忽略空项
+func EnvList(name string) []string {
+	var list []string
+	for _, s := range strings.Split(os.Getenv(name), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// 日志初始化之前读取环境变量时Log还不存在，输出到标准错误
+func envWarnf(format string, args ...interface{}) {
+	if Log != nil {
+		Log.Warnf(format, args...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
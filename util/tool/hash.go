@@ -0,0 +1,17 @@
+package tool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// 计算数据json序列化后的sha256
+func ContentHash(v interface{}) (string, error) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(jsonBytes)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,94 @@
+package tool
+
+import (
+	"github.com/rifflock/lfshook"
+	"github.com/sirupsen/logrus"
+	"io"
+	"kappagent/util/rotate"
+	"os"
+	"time"
+)
+
+const (
+	envLogLevel      = "LOG_LEVEL"
+	envLogFormat     = "LOG_FORMAT"
+	envLogOutput     = "LOG_OUTPUT"
+	envLogFile       = "LOG_FILE"
+	envLogErrorFile  = "LOG_ERROR_FILE"
+	envLogMaxSize    = "LOG_MAX_SIZE"
+	envLogMaxAge     = "LOG_MAX_AGE"
+	envLogMaxBackups = "LOG_MAX_BACKUPS"
+	envLogCompress   = "LOG_COMPRESS"
+)
+
+// 日志结构化字段
+const (
+	FieldCluster   = "cluster"
+	FieldResource  = "resource"
+	FieldNamespace = "namespace"
+	FieldName      = "name"
+	FieldEvent     = "event"
+)
+
+func newLogger() *logrus.Logger {
+	if Log != nil {
+		return Log
+	}
+	Log = logrus.New()
+
+	level, err := logrus.ParseLevel(EnvString(envLogLevel, "info"))
+	if err != nil {
+		envWarnf("日志级别不合法: %s", err)
+		level = logrus.InfoLevel
+	}
+	Log.SetLevel(level)
+
+	if EnvString(envLogFormat, "json") == "text" {
+		Log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	} else {
+		Log.SetFormatter(&logrus.JSONFormatter{})
+	}
+
+	var writers []io.Writer
+	outputs := EnvList(envLogOutput)
+	if len(outputs) == 0 {
+		outputs = []string{"stdout", "file"}
+	}
+	for _, o := range outputs {
+		switch o {
+		case "stdout":
+			writers = append(writers, os.Stdout)
+		case "stderr":
+			writers = append(writers, os.Stderr)
+		case "file":
+			writers = append(writers, newLogFile(EnvString(envLogFile, "./log/info.log")))
+		default:
+			envWarnf("不支持的日志输出: %s", o)
+		}
+	}
+	if len(writers) == 0 {
+		writers = append(writers, os.Stdout)
+	}
+	Log.SetOutput(io.MultiWriter(writers...))
+
+	// error及以上级别额外写一份文件
+	if errorFile := EnvString(envLogErrorFile, ""); errorFile != "" {
+		w := newLogFile(errorFile)
+		Log.Hooks.Add(lfshook.NewHook(lfshook.WriterMap{
+			logrus.ErrorLevel: w,
+			logrus.FatalLevel: w,
+			logrus.PanicLevel: w,
+		}, Log.Formatter))
+	}
+	return Log
+}
+
+func newLogFile(filename string) *rotate.Writer {
+	return &rotate.Writer{
+		Filename:   filename,
+		MaxSize:    int64(EnvInt(envLogMaxSize, 100)) * 1024 * 1024,
+		MaxAge:     EnvDuration(envLogMaxAge, 7*24*time.Hour),
+		MaxBackups: EnvInt(envLogMaxBackups, 7),
+		Compress:   EnvBool(envLogCompress, false),
+	}
+}
@@ -1,9 +1,10 @@
 package tool
 
 import (
-	"github.com/rifflock/lfshook"
+	"context"
 	"github.com/segmentio/kafka-go"
 	"github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"k8s.io/apimachinery/pkg/watch"
 	"net/http"
@@ -34,37 +35,43 @@ func HomeDir() string {
 }
 
 // reg
-func RegCluster(data string, siteUrl string) bool {
-	Log.Info("正在注册数据...")
-	resp, err := http.PostForm(siteUrl, url.Values{"data": {data}})
+func RegCluster(ctx context.Context, client *http.Client, data string, siteUrl string) bool {
+	log := Log.WithField("url", siteUrl)
+	log.Info("正在注册数据...")
+	resp, err := postForm(ctx, client, siteUrl, url.Values{"data": {data}})
 	if err != nil {
-		Log.Error("链接地址失败:" + err.Error())
+		log.WithError(err).Error("链接地址失败")
 		return false
 	} else {
 		defer func() {
+			// 读完body后连接才能复用
+			io.Copy(ioutil.Discard, resp.Body)
 			err := resp.Body.Close()
 			if err != nil {
-				Log.Error(err.Error())
+				log.Error(err.Error())
 			}
 		}()
 
 		if resp.StatusCode == 200 {
-			Log.Info("数据注册完成...")
+			log.Info("数据注册完成...")
 			return true
 		} else {
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				Log.Error("读取数据失败:" + err.Error())
+				log.WithError(err).Error("读取数据失败")
 			} else {
-				Log.Warn("数据注册失败:", string(body))
+				log.WithFields(logrus.Fields{
+					"status": resp.StatusCode,
+					"body":   string(body),
+				}).Warn("数据注册失败")
 			}
 			return false
 		}
 	}
 }
 
-// 发送数据
-func HttpPostForm(data, siteUrl string, wtype watch.EventType) {
+// 发送数据，发送成功返回true
+func HttpPostForm(ctx context.Context, client *http.Client, data, siteUrl string, wtype watch.EventType) bool {
 	//Log.Info("正在发送数据...")
 	//
 	//msg := kafka.Message{
@@ -78,44 +85,50 @@ func HttpPostForm(data, siteUrl string, wtype watch.EventType) {
 	//
 	//Log.Info("发送成功")
 
-	resp, err := http.PostForm(siteUrl, url.Values{"data": {data}})
+	log := Log.WithFields(logrus.Fields{
+		"url":      siteUrl,
+		FieldEvent: wtype,
+	})
+	resp, err := postForm(ctx, client, siteUrl, url.Values{"data": {data}})
 	if err != nil {
-		Log.Error("链接地址失败:" + err.Error())
+		log.WithError(err).Error("链接地址失败")
+		return false
 	} else {
 		defer func() {
+			// 读完body后连接才能复用
+			io.Copy(ioutil.Discard, resp.Body)
 			err := resp.Body.Close()
 			if err != nil {
-				Log.Error(err.Error())
+				log.Error(err.Error())
 			}
 		}()
 
 		if resp.StatusCode == 200 {
-			Log.Info("数据发送完成...")
+			log.Info("数据发送完成...")
+			return true
 		} else {
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				Log.Error("读取数据失败:" + err.Error())
+				log.WithError(err).Error("读取数据失败")
 			} else {
-				Log.Warn("数据发送失败:", string(body))
+				log.WithFields(logrus.Fields{
+					"status": resp.StatusCode,
+					"body":   string(body),
+				}).Warn("数据发送失败")
 			}
+			return false
 		}
 	}
 }
 
-func newLogger() *logrus.Logger {
-	if Log != nil {
-		return Log
-	}
-	pathMap := lfshook.PathMap{
-		logrus.InfoLevel:  "./log/info.log",
-		logrus.ErrorLevel: "./log/error.log",
+// 与 client.PostForm 相同，ctx 取消时中断请求
+func postForm(ctx context.Context, client *http.Client, siteUrl string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, siteUrl, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
 	}
-	Log = logrus.New()
-	Log.Hooks.Add(lfshook.NewHook(
-		pathMap,
-		&logrus.JSONFormatter{},
-	))
-	return Log
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req.WithContext(ctx))
 }
 
 func newKafkaWriter(kafkaURL, topic string) *kafka.Writer {